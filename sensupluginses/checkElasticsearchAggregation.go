@@ -0,0 +1,233 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"github.com/yieldbot/sensuplugin/sensuutil"
+	"golang.org/x/net/context"
+)
+
+// aggregation configuration
+var aggIndices []string
+var aggQueryString string
+var aggQueryJSON string
+var aggSince time.Duration
+var aggTimestampField string
+var aggType string
+var aggField string
+var aggPercentile float64
+var aggGroupBy string
+var aggGroupSize int
+var aggWarn float64
+var aggCrit float64
+var aggInvert bool
+
+// checkElasticsearchAggregationCmd alerts on a metric aggregated from the documents in a time window
+var checkElasticsearchAggregationCmd = &cobra.Command{
+	Use:   "checkElasticsearchAggregation --indices <pattern> --agg <type> --field <field> --since <duration> --warn <n> --crit <n>",
+	Short: "Alert when an avg, min, max, sum, percentile or cardinality over a field crosses a threshold.",
+	Long: `This will run the aggregation given by --agg over --field for the documents in --indices matching
+  --query or --query-json within the last --since and alert when the result is above --warn or --crit,
+  or below them with --invert. No value, because no documents matched, is unknown, or below the
+  thresholds with --invert. With --group-by the aggregation is run for each of the top terms of
+  that field. When --sensu-socket is also given every bucket is sent to the sensu client socket as its
+  own check result named after the check and the bucket, with the cluster name as its source.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		metric, err := metricAggregation()
+		if err != nil {
+			sensuutil.Exit("CONFIGERROR", err.Error())
+		}
+		clause, err := queryClause(aggQueryJSON)
+		if err != nil {
+			sensuutil.Exit("CONFIGERROR", err.Error())
+		}
+
+		client := checkEsClient()
+
+		search := client.Search(aggIndices...).
+			Query(windowQuery(aggQueryString, clause, aggTimestampField, aggSince)).
+			Size(0)
+		if aggGroupBy != "" {
+			search = search.Aggregation("group", elastic.NewTermsAggregation().Field(aggGroupBy).Size(aggGroupSize).SubAggregation("metric", metric))
+		} else {
+			search = search.Aggregation("metric", metric)
+		}
+		res, err := search.Do(context.Background())
+		if err != nil {
+			checkUnknown("Could not run the aggregation", err)
+		}
+
+		label := aggLabel()
+		out := new(checkOutput)
+
+		if aggGroupBy == "" {
+			value, ok := metricValue(res.Aggregations)
+			if !ok {
+				out.alert(missingState(), "no documents to aggregate")
+				out.exit(fmt.Sprintf("No value for %s over the last %s", label, aggSince))
+			}
+			out.alert(thresholdState(value, aggWarn, aggCrit, aggInvert), fmt.Sprintf("%s is %.2f", label, value))
+			out.perf(perfLabel(label), fmt.Sprintf("%.2f", value))
+			out.exit(fmt.Sprintf("%s over the last %s is %.2f", label, aggSince, value))
+		}
+
+		groups, ok := res.Aggregations.Terms("group")
+		if !ok {
+			checkUnknown("Could not run the aggregation", fmt.Errorf("no %s buckets returned", aggGroupBy))
+		}
+		if len(groups.Buckets) == 0 {
+			out.alert(missingState(), "no documents to aggregate")
+			out.exit(fmt.Sprintf("No %s buckets for %s over the last %s", aggGroupBy, label, aggSince))
+		}
+		source := clusterSource(context.Background(), client)
+		for _, bucket := range groups.Buckets {
+			key := fmt.Sprintf("%v", bucket.Key)
+			value, ok := metricValue(bucket.Aggregations)
+			if !ok {
+				out.alertFor(source, key, missingState(), fmt.Sprintf("%s for %s=%s has no value", label, aggGroupBy, key))
+				continue
+			}
+			out.alertFor(source, key, thresholdState(value, aggWarn, aggCrit, aggInvert), fmt.Sprintf("%s for %s=%s is %.2f", label, aggGroupBy, key, value))
+			out.perfFor(source, key, label, fmt.Sprintf("%.2f", value))
+		}
+
+		out.exit(fmt.Sprintf("%s by %s over the last %s for %d buckets", label, aggGroupBy, aggSince, len(groups.Buckets)))
+	},
+}
+
+// metricAggregation builds the aggregation requested on the commandline.
+func metricAggregation() (elastic.Aggregation, error) {
+	if aggField == "" {
+		return nil, fmt.Errorf("--field is required")
+	}
+
+	switch aggType {
+	case "avg":
+		return elastic.NewAvgAggregation().Field(aggField), nil
+	case "min":
+		return elastic.NewMinAggregation().Field(aggField), nil
+	case "max":
+		return elastic.NewMaxAggregation().Field(aggField), nil
+	case "sum":
+		return elastic.NewSumAggregation().Field(aggField), nil
+	case "cardinality":
+		return elastic.NewCardinalityAggregation().Field(aggField), nil
+	case "percentiles":
+		return elastic.NewPercentilesAggregation().Field(aggField).Percentiles(aggPercentile), nil
+	default:
+		return nil, fmt.Errorf("unsupported aggregation %q, use avg, min, max, sum, cardinality or percentiles", aggType)
+	}
+}
+
+// metricValue reads the result of the metric aggregation. The second value is false when there were no
+// documents to aggregate.
+func metricValue(aggs elastic.Aggregations) (float64, bool) {
+	if aggType == "percentiles" {
+		// percentiles of no documents are null, which the vendored client would read as 0
+		raw, ok := aggs["metric"]
+		if !ok || raw == nil {
+			return 0, false
+		}
+		var p struct {
+			Values map[string]*float64 `json:"values"`
+		}
+		if err := json.Unmarshal(*raw, &p); err != nil {
+			return 0, false
+		}
+		for _, v := range p.Values {
+			if v == nil {
+				return 0, false
+			}
+			return *v, true
+		}
+		return 0, false
+	}
+
+	var m *elastic.AggregationValueMetric
+	var ok bool
+	switch aggType {
+	case "avg":
+		m, ok = aggs.Avg("metric")
+	case "min":
+		m, ok = aggs.Min("metric")
+	case "max":
+		m, ok = aggs.Max("metric")
+	case "sum":
+		m, ok = aggs.Sum("metric")
+	case "cardinality":
+		m, ok = aggs.Cardinality("metric")
+	}
+	if !ok || m.Value == nil {
+		return 0, false
+	}
+	return *m.Value, true
+}
+
+// missingState is the state of an aggregation without a value. With --invert no documents is below every threshold
+// that is set; otherwise, or with no threshold set, there is nothing to compare and the result is unknown.
+func missingState() string {
+	if aggInvert {
+		if state := thresholdState(math.Inf(-1), aggWarn, aggCrit, true); state != "OK" {
+			return state
+		}
+	}
+	return "UNKNOWN"
+}
+
+// aggLabel names the aggregation for the check output, e.g. avg(bytes) or p99(latency).
+func aggLabel() string {
+	name := aggType
+	if aggType == "percentiles" {
+		name = fmt.Sprintf("p%g", aggPercentile)
+	}
+	return name + "(" + aggField + ")"
+}
+
+func init() {
+	RootCmd.AddCommand(checkElasticsearchAggregationCmd)
+
+	// set commandline flags
+	checkElasticsearchAggregationCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	checkElasticsearchAggregationCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	checkElasticsearchAggregationCmd.Flags().StringSliceVarP(&aggIndices, "indices", "", []string{"logstash-*"}, "the index pattern to aggregate over")
+	checkElasticsearchAggregationCmd.Flags().StringVarP(&aggQueryString, "query", "", "", "a lucene query string limiting the documents")
+	checkElasticsearchAggregationCmd.Flags().StringVarP(&aggQueryJSON, "query-json", "", "", "a JSON query clause or search body with a query key, used instead of --query")
+	checkElasticsearchAggregationCmd.Flags().DurationVarP(&aggSince, "since", "", 5*time.Minute, "only aggregate documents newer than this (0 disables)")
+	checkElasticsearchAggregationCmd.Flags().StringVarP(&aggTimestampField, "timestamp-field", "", "@timestamp", "the field holding the document timestamp")
+	checkElasticsearchAggregationCmd.Flags().StringVarP(&aggType, "agg", "", "avg", "the aggregation to run: avg, min, max, sum, cardinality or percentiles")
+	checkElasticsearchAggregationCmd.Flags().StringVarP(&aggField, "field", "", "", "the field to aggregate")
+	checkElasticsearchAggregationCmd.Flags().Float64VarP(&aggPercentile, "percentile", "", 99, "the percentile to calculate for --agg percentiles")
+	checkElasticsearchAggregationCmd.Flags().StringVarP(&aggGroupBy, "group-by", "", "", "run the aggregation for each of the top terms of this field")
+	checkElasticsearchAggregationCmd.Flags().IntVarP(&aggGroupSize, "group-size", "", 10, "the number of terms to group by")
+	checkElasticsearchAggregationCmd.Flags().Float64VarP(&aggWarn, "warn", "", -1, "warn when the result is above this")
+	checkElasticsearchAggregationCmd.Flags().Float64VarP(&aggCrit, "crit", "", -1, "critical when the result is above this")
+	checkElasticsearchAggregationCmd.Flags().BoolVarP(&aggInvert, "invert", "", false, "alert when the result is below the thresholds instead")
+	addSensuSocketFlags(checkElasticsearchAggregationCmd)
+}
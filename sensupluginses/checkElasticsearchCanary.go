@@ -0,0 +1,168 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+// canary configuration
+var canaryIndex string
+var canarySearch bool
+var canaryWarn time.Duration
+var canaryCrit time.Duration
+
+// canaryPhase is one step of the canary round trip.
+type canaryPhase struct {
+	name string
+	run  func(ctx context.Context, client *elastic.Client, id string) error
+}
+
+// canaryPhases are run in order for every canary document. A failing phase stops the round trip.
+var canaryPhases = []canaryPhase{
+	{"index", indexCanary},
+	{"get", getCanary},
+	{"search", searchCanary},
+	{"delete", deleteCanary},
+}
+
+// checkElasticsearchCanaryCmd proves documents can be written to and read back from the cluster
+var checkElasticsearchCanaryCmd = &cobra.Command{
+	Use:   "checkElasticsearchCanary --host <host> --port <port> --index <index> [--search]",
+	Short: "Write a canary document, read it back and delete it, alerting on failures or slow phases.",
+	Long: `A green cluster does not mean writes work. This will index a document with a unique id into --index,
+  get it back by id, optionally refresh the index and search for it with --search, then delete it. The
+  check is critical when any phase fails and alerts when a phase takes longer than --warn or --crit.
+  A phase still running after --crit is abandoned and reported as failed. The latency of every phase
+  is reported as perfdata.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		client := checkEsClient()
+		ctx := context.Background()
+		id := fmt.Sprintf("%s-%d", host, time.Now().UnixNano())
+
+		out := new(checkOutput)
+		for _, phase := range canaryPhases {
+			if phase.name == "search" && !canarySearch {
+				continue
+			}
+
+			phaseCtx, cancel := canaryContext(ctx)
+			start := time.Now()
+			err := phase.run(phaseCtx, client, id)
+			took := time.Since(start)
+			cancel()
+
+			out.perf(phase.name+"_ms", int64(took/time.Millisecond))
+			if err != nil {
+				out.alert("CRITICAL", fmt.Sprintf("%s failed: %v", phase.name, err))
+				if phase.name != "delete" {
+					// best effort clean up, the failure has already been reported
+					cleanupCtx, cancel := canaryContext(ctx)
+					deleteCanary(cleanupCtx, client, id)
+					cancel()
+				}
+				break
+			}
+
+			state := "OK"
+			switch {
+			case canaryCrit > 0 && took > canaryCrit:
+				state = "CRITICAL"
+			case canaryWarn > 0 && took > canaryWarn:
+				state = "WARNING"
+			}
+			out.alert(state, fmt.Sprintf("%s took %s", phase.name, took))
+		}
+
+		out.exit("Canary round trip through " + canaryIndex)
+	},
+}
+
+// canaryContext limits a phase to --crit so a hung cluster fails the check instead of outliving the check timeout.
+func canaryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if canaryCrit <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, canaryCrit)
+}
+
+// indexCanary writes the canary document.
+func indexCanary(ctx context.Context, client *elastic.Client, id string) error {
+	doc := map[string]interface{}{
+		"canary":    id,
+		"client":    host,
+		"timestamp": time.Now().Format(time.RFC3339),
+	}
+	_, err := client.Index().Index(canaryIndex).Type("canary").Id(id).BodyJson(doc).Do(ctx)
+	return err
+}
+
+// getCanary reads the canary document back by id.
+func getCanary(ctx context.Context, client *elastic.Client, id string) error {
+	res, err := client.Get().Index(canaryIndex).Type("canary").Id(id).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if !res.Found {
+		return fmt.Errorf("document %s not found", id)
+	}
+	return nil
+}
+
+// searchCanary refreshes the canary index and searches for the canary document.
+func searchCanary(ctx context.Context, client *elastic.Client, id string) error {
+	if _, err := client.Refresh(canaryIndex).Do(ctx); err != nil {
+		return err
+	}
+	res, err := client.Search(canaryIndex).Query(elastic.NewIdsQuery("canary").Ids(id)).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if res.TotalHits() != 1 {
+		return fmt.Errorf("document %s not searchable", id)
+	}
+	return nil
+}
+
+// deleteCanary removes the canary document.
+func deleteCanary(ctx context.Context, client *elastic.Client, id string) error {
+	_, err := client.Delete().Index(canaryIndex).Type("canary").Id(id).Do(ctx)
+	return err
+}
+
+func init() {
+	RootCmd.AddCommand(checkElasticsearchCanaryCmd)
+
+	// set commandline flags
+	checkElasticsearchCanaryCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	checkElasticsearchCanaryCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	checkElasticsearchCanaryCmd.Flags().StringVarP(&canaryIndex, "index", "", CanaryEsIndex, "the dedicated index to write the canary into")
+	checkElasticsearchCanaryCmd.Flags().BoolVarP(&canarySearch, "search", "", false, "also refresh the index and search for the canary")
+	checkElasticsearchCanaryCmd.Flags().DurationVarP(&canaryWarn, "warn", "", time.Second, "warn when a phase takes longer than this")
+	checkElasticsearchCanaryCmd.Flags().DurationVarP(&canaryCrit, "crit", "", 5*time.Second, "critical when a phase takes longer than this, phases are abandoned after it")
+}
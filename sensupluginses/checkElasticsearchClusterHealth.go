@@ -0,0 +1,132 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+// cluster health thresholds
+var healthLevel string
+var healthIndices []string
+var healthUnassignedWarn int
+var healthUnassignedCrit int
+var healthInitializingWarn int
+var healthInitializingCrit int
+var healthRelocatingWarn int
+var healthRelocatingCrit int
+var healthNodesWarn int
+var healthNodesCrit int
+
+// healthStates maps the elasticsearch health colors onto sensu check states.
+var healthStates = map[string]string{
+	"green":  "OK",
+	"yellow": "WARNING",
+	"red":    "CRITICAL",
+}
+
+// checkElasticsearchClusterHealthCmd alerts on the health of the elasticsearch cluster itself
+var checkElasticsearchClusterHealthCmd = &cobra.Command{
+	Use:   "checkElasticsearchClusterHealth --host <host> --port <port> [--level cluster|indices]",
+	Short: "Alert on the health status, shard allocation and node count of an elasticsearch cluster.",
+	Long: `This will map the cluster health of green, yellow and red onto OK, WARNING and CRITICAL. Thresholds
+  can additionally be set on the number of unassigned, initializing and relocating shards and on the
+  minimum number of nodes; a negative threshold is disabled. With --level indices the health of every
+  index, optionally limited with --indices, is reported individually.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		client := checkEsClient()
+
+		svc := client.ClusterHealth().Level(healthLevel)
+		if len(healthIndices) > 0 {
+			svc = svc.Index(healthIndices...)
+		}
+		health, err := svc.Do(context.Background())
+		if err != nil {
+			checkUnknown("Could not read the cluster health", err)
+		}
+
+		out := new(checkOutput)
+		out.alert(healthState(health.Status), "cluster status is "+health.Status)
+
+		out.alert(thresholdState(float64(health.UnassignedShards), float64(healthUnassignedWarn), float64(healthUnassignedCrit), false),
+			fmt.Sprintf("%d unassigned shards", health.UnassignedShards))
+		out.alert(thresholdState(float64(health.InitializingShards), float64(healthInitializingWarn), float64(healthInitializingCrit), false),
+			fmt.Sprintf("%d initializing shards", health.InitializingShards))
+		out.alert(thresholdState(float64(health.RelocatingShards), float64(healthRelocatingWarn), float64(healthRelocatingCrit), false),
+			fmt.Sprintf("%d relocating shards", health.RelocatingShards))
+		out.alert(thresholdState(float64(health.NumberOfNodes), float64(healthNodesWarn), float64(healthNodesCrit), true),
+			fmt.Sprintf("only %d nodes", health.NumberOfNodes))
+
+		var names []string
+		for name := range health.Indices {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			out.alertFor(health.ClusterName, name, healthState(health.Indices[name].Status), fmt.Sprintf("index %s is %s", name, health.Indices[name].Status))
+		}
+
+		out.perf("nodes", health.NumberOfNodes)
+		out.perf("data_nodes", health.NumberOfDataNodes)
+		out.perf("active_primary_shards", health.ActivePrimaryShards)
+		out.perf("active_shards", health.ActiveShards)
+		out.perf("unassigned_shards", health.UnassignedShards)
+		out.perf("initializing_shards", health.InitializingShards)
+		out.perf("relocating_shards", health.RelocatingShards)
+		out.perf("pending_tasks", health.NumberOfPendingTasks)
+		out.perf("active_shards_percent", fmt.Sprintf("%.1f%%", health.ActiveShardsPercentAsNumber))
+
+		out.exit(fmt.Sprintf("Cluster %s is %s", health.ClusterName, health.Status))
+	},
+}
+
+// healthState converts an elasticsearch health color into a sensu check state.
+func healthState(status string) string {
+	if state, ok := healthStates[status]; ok {
+		return state
+	}
+	return "UNKNOWN"
+}
+
+func init() {
+	RootCmd.AddCommand(checkElasticsearchClusterHealthCmd)
+
+	// set commandline flags
+	checkElasticsearchClusterHealthCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	checkElasticsearchClusterHealthCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	checkElasticsearchClusterHealthCmd.Flags().StringVarP(&healthLevel, "level", "", "cluster", "report health at the cluster or indices level")
+	checkElasticsearchClusterHealthCmd.Flags().StringSliceVarP(&healthIndices, "indices", "", nil, "limit the health to these indices")
+	checkElasticsearchClusterHealthCmd.Flags().IntVarP(&healthUnassignedWarn, "unassigned-warn", "", -1, "warn when more shards than this are unassigned")
+	checkElasticsearchClusterHealthCmd.Flags().IntVarP(&healthUnassignedCrit, "unassigned-crit", "", -1, "critical when more shards than this are unassigned")
+	checkElasticsearchClusterHealthCmd.Flags().IntVarP(&healthInitializingWarn, "initializing-warn", "", -1, "warn when more shards than this are initializing")
+	checkElasticsearchClusterHealthCmd.Flags().IntVarP(&healthInitializingCrit, "initializing-crit", "", -1, "critical when more shards than this are initializing")
+	checkElasticsearchClusterHealthCmd.Flags().IntVarP(&healthRelocatingWarn, "relocating-warn", "", -1, "warn when more shards than this are relocating")
+	checkElasticsearchClusterHealthCmd.Flags().IntVarP(&healthRelocatingCrit, "relocating-crit", "", -1, "critical when more shards than this are relocating")
+	checkElasticsearchClusterHealthCmd.Flags().IntVarP(&healthNodesWarn, "nodes-warn", "", -1, "warn when fewer nodes than this are in the cluster")
+	checkElasticsearchClusterHealthCmd.Flags().IntVarP(&healthNodesCrit, "nodes-crit", "", -1, "critical when fewer nodes than this are in the cluster")
+	addSensuSocketFlags(checkElasticsearchClusterHealthCmd)
+}
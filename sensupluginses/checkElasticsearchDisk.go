@@ -0,0 +1,223 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+// disk remediation
+var diskRemediate bool
+
+// readOnlyBlock is the index setting elasticsearch applies when a node crosses the flood stage watermark.
+const readOnlyBlock = "index.blocks.read_only_allow_delete"
+
+// diskWatermarks lists the watermark settings from least to most severe along with the elasticsearch defaults
+// used when the cluster does not report them.
+var diskWatermarks = []struct {
+	name    string
+	setting string
+	def     string
+	state   string
+}{
+	{"low", "cluster.routing.allocation.disk.watermark.low", "85%", "WARNING"},
+	{"high", "cluster.routing.allocation.disk.watermark.high", "90%", "CRITICAL"},
+	{"flood_stage", "cluster.routing.allocation.disk.watermark.flood_stage", "95%", "CRITICAL"},
+}
+
+// watermark is a disk watermark given either as a used percentage or as an amount of free space.
+type watermark struct {
+	percent   float64
+	freeBytes int64
+}
+
+// byteUnits are the size suffixes elasticsearch accepts for byte values.
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"pb", 1 << 50},
+	{"tb", 1 << 40},
+	{"gb", 1 << 30},
+	{"mb", 1 << 20},
+	{"kb", 1 << 10},
+	{"b", 1},
+}
+
+// checkElasticsearchDiskCmd alerts on nodes approaching the disk watermarks and on read only indices
+var checkElasticsearchDiskCmd = &cobra.Command{
+	Use:   "checkElasticsearchDisk --host <host> --port <port> [--remediate]",
+	Short: "Alert when node disk usage crosses the cluster disk watermarks or indices have been made read only.",
+	Long: `This will compare the disk usage of every node against the low, high and flood stage watermarks
+  configured in the cluster settings, warning at the low watermark and going critical at the high and
+  flood stage watermarks. Indices carrying the index.blocks.read_only_allow_delete block are critical.
+  With --remediate the block is cleared once every node is back under the high watermark.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		client := checkEsClient()
+		ctx := context.Background()
+
+		settings, err := clusterSettings(ctx, client)
+		if err != nil {
+			checkUnknown("Could not read the cluster settings", err)
+		}
+		marks := make([]watermark, len(diskWatermarks))
+		for i, w := range diskWatermarks {
+			value := w.def
+			if v, ok := settings[w.setting].(string); ok && v != "" {
+				value = v
+			}
+			if marks[i], err = parseWatermark(value); err != nil {
+				checkUnknown("Could not parse the "+w.setting+" setting", err)
+			}
+		}
+
+		stats, err := client.NodesStats().Metric("fs").Do(ctx)
+		if err != nil {
+			checkUnknown("Could not read the node stats", err)
+		}
+
+		out := new(checkOutput)
+		aboveHigh := false
+		for _, id := range sortedNodeIDs(stats) {
+			node := stats.Nodes[id]
+			if node.FS == nil || node.FS.Total == nil || node.FS.Total.TotalInBytes == 0 {
+				continue
+			}
+			fs := node.FS.Total
+			used := 100 * float64(fs.TotalInBytes-fs.AvailableInBytes) / float64(fs.TotalInBytes)
+
+			state, message := "OK", fmt.Sprintf("%s disk %.1f%% used", node.Name, used)
+			for i := len(diskWatermarks) - 1; i >= 0; i-- {
+				if marks[i].crossed(used, fs.AvailableInBytes) {
+					state = diskWatermarks[i].state
+					message += " is over the " + diskWatermarks[i].name + " watermark"
+					aboveHigh = aboveHigh || i > 0
+					break
+				}
+			}
+			out.alertFor(node.Name, "", state, message)
+			out.perfFor(node.Name, "", "disk_used_percent", fmt.Sprintf("%.1f%%", used))
+			out.perfFor(node.Name, "", "disk_available_bytes", fmt.Sprintf("%dB", fs.AvailableInBytes))
+		}
+
+		blocked, err := readOnlyIndices(ctx, client)
+		if err != nil {
+			checkUnknown("Could not read the index settings", err)
+		}
+		if len(blocked) > 0 && diskRemediate && !aboveHigh {
+			if err := clearReadOnlyBlock(ctx, client, blocked); err != nil {
+				out.alert("CRITICAL", fmt.Sprintf("could not clear the read only block: %v", err))
+			} else {
+				syslogLog.WithFields(logrus.Fields{
+					"check":   "sensupluginses",
+					"client":  host,
+					"esHost":  esHost,
+					"indices": blocked,
+				}).Info(`Cleared the read only block from indices`)
+				out.note(fmt.Sprintf("cleared the read only block on %d indices", len(blocked)))
+				blocked = nil
+			}
+		}
+		for _, index := range blocked {
+			out.alert("CRITICAL", "index "+index+" is read only")
+		}
+		out.perf("read_only_indices", len(blocked))
+
+		out.exit(fmt.Sprintf("Disk usage for %d nodes", len(stats.Nodes)))
+	},
+}
+
+// parseWatermark reads a watermark setting given as a percentage, a ratio or an absolute amount of free space.
+func parseWatermark(value string) (watermark, error) {
+	v := strings.ToLower(strings.TrimSpace(value))
+
+	if strings.HasSuffix(v, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+		return watermark{percent: percent}, err
+	}
+	if ratio, err := strconv.ParseFloat(v, 64); err == nil {
+		return watermark{percent: ratio * 100}, nil
+	}
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(v, unit.suffix) {
+			size, err := strconv.ParseFloat(strings.TrimSuffix(v, unit.suffix), 64)
+			return watermark{freeBytes: int64(size * float64(unit.size))}, err
+		}
+	}
+	return watermark{}, fmt.Errorf("unrecognized watermark %q", value)
+}
+
+// crossed reports whether a disk with the given usage is over the watermark.
+func (w watermark) crossed(usedPercent float64, availableBytes int64) bool {
+	if w.freeBytes > 0 {
+		return availableBytes < w.freeBytes
+	}
+	return usedPercent > w.percent
+}
+
+// readOnlyIndices returns the indices carrying the read only allow delete block.
+func readOnlyIndices(ctx context.Context, client *elastic.Client) ([]string, error) {
+	res, err := client.IndexGetSettings("_all").Name(readOnlyBlock).FlatSettings(true).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocked []string
+	for index, s := range res {
+		if s == nil {
+			continue
+		}
+		if v := fmt.Sprintf("%v", s.Settings[readOnlyBlock]); v == "true" {
+			blocked = append(blocked, index)
+		}
+	}
+	sort.Strings(blocked)
+	return blocked, nil
+}
+
+// clearReadOnlyBlock removes the read only allow delete block from the given indices.
+func clearReadOnlyBlock(ctx context.Context, client *elastic.Client, indices []string) error {
+	_, err := client.IndexPutSettings(indices...).
+		FlatSettings(true).
+		BodyJson(map[string]interface{}{readOnlyBlock: nil}).
+		Do(ctx)
+	return err
+}
+
+func init() {
+	RootCmd.AddCommand(checkElasticsearchDiskCmd)
+
+	// set commandline flags
+	checkElasticsearchDiskCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	checkElasticsearchDiskCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	checkElasticsearchDiskCmd.Flags().BoolVarP(&diskRemediate, "remediate", "", false, "clear the read only block once all nodes are under the high watermark")
+	addSensuSocketFlags(checkElasticsearchDiskCmd)
+}
@@ -0,0 +1,346 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"github.com/yieldbot/sensuplugin/sensuutil"
+	"golang.org/x/net/context"
+)
+
+// drift configuration
+var driftDir string
+
+// driftKind describes one kind of object that can be compared, where its expected definitions live under the
+// drift directory and how to read it from the cluster. Keys the cluster has under one of the strict prefixes but the
+// expected definition leaves out are reported, an empty prefix covering the whole object.
+type driftKind struct {
+	dir      string
+	path     func(name string) string
+	live     func(body map[string]interface{}, name string) interface{}
+	expected func(v interface{}) interface{}
+	strict   []string
+}
+
+// driftKinds are the objects compared against the cluster. Each file in the directory is named after the object.
+var driftKinds = []driftKind{
+	{"templates", func(n string) string { return "/_template/" + n }, byName, nil, []string{"mappings", "settings"}},
+	{"mappings", func(n string) string { return "/" + n + "/_mapping" }, byName, nil, []string{""}},
+	{"aliases", func(n string) string { return "/_alias/" + n }, aliasIndices, expectedAliasIndices, []string{""}},
+	{"ilm", func(n string) string { return "/_ilm/policy/" + n }, byName, nil, nil},
+}
+
+// checkElasticsearchDriftCmd alerts when templates, mappings, settings or aliases no longer match what is in git
+var checkElasticsearchDriftCmd = &cobra.Command{
+	Use:   "checkElasticsearchDrift --host <host> --port <port> --dir <directory>",
+	Short: "Alert when index templates, mappings, cluster settings, aliases or ILM policies drift from their definitions.",
+	Long: `This will load the expected definitions from the JSON files in --dir and compare them with the live
+  cluster, warning with a readable diff of anything that was changed by hand. The directory holds
+  templates/<name>.json, mappings/<index>.json, aliases/<alias>.json listing the expected indices,
+  ilm/<policy>.json and cluster_settings.json holding flat setting names. Keys in the live mappings,
+  aliases, template mappings and settings and the explicitly set cluster settings that are not in the
+  expected definitions are reported too, other defaults added by elasticsearch are not.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		definitions, settings := loadDefinitions(driftDir)
+
+		client := checkEsClient()
+		ctx := context.Background()
+
+		var diffs []string
+		for _, def := range definitions {
+			live, err := liveObject(ctx, client, def.kind, def.name)
+			if err != nil {
+				checkUnknown("Could not read "+def.kind.dir+"/"+def.name, err)
+			}
+			diffs = append(diffs, diffObjects(def.kind.dir+"/"+def.name, def.expected, live, def.kind.strict)...)
+		}
+
+		compared := len(definitions)
+		if settings != nil {
+			live, err := clusterSettings(ctx, client)
+			if err != nil {
+				checkUnknown("Could not read the cluster settings", err)
+			}
+			explicit, err := explicitClusterSettings(ctx, client)
+			if err != nil {
+				checkUnknown("Could not read the cluster settings", err)
+			}
+			compared++
+			diffs = append(diffs, diffObjects("cluster_settings", settings, live, nil)...)
+			diffs = append(diffs, unexpectedKeys("cluster_settings", flatten(settings), flatten(explicit), []string{""})...)
+		}
+
+		if len(diffs) == 0 {
+			sensuutil.Exit("OK", fmt.Sprintf("%d definitions in %s match the cluster", compared, driftDir))
+		}
+		sensuutil.Exit("WARNING", fmt.Sprintf("%d differences from the definitions in %s\n%s", len(diffs), driftDir, strings.Join(diffs, "\n")))
+	},
+}
+
+// driftDefinition is an expected definition read from the drift directory.
+type driftDefinition struct {
+	kind     driftKind
+	name     string
+	expected interface{}
+}
+
+// loadDefinitions reads every expected definition and the expected cluster settings from dir, exiting with a
+// config error when the directory is missing, holds no definitions or a file can not be read.
+func loadDefinitions(dir string) ([]driftDefinition, interface{}) {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		sensuutil.Exit("CONFIGERROR", fmt.Sprintf("%s is not a directory of definitions", dir))
+	}
+
+	var definitions []driftDefinition
+	for _, kind := range driftKinds {
+		files, err := filepath.Glob(filepath.Join(dir, kind.dir, "*.json"))
+		if err != nil {
+			sensuutil.Exit("CONFIGERROR", fmt.Sprintf("Could not list the %s in %s: %v", kind.dir, dir, err))
+		}
+		for _, file := range files {
+			expected, err := readExpected(file)
+			if err != nil {
+				sensuutil.Exit("CONFIGERROR", fmt.Sprintf("Could not read %s: %v", file, err))
+			}
+			if kind.expected != nil {
+				expected = kind.expected(expected)
+			}
+			name := strings.TrimSuffix(filepath.Base(file), ".json")
+			definitions = append(definitions, driftDefinition{kind, name, expected})
+		}
+	}
+
+	settingsFile := filepath.Join(dir, "cluster_settings.json")
+	settings, err := readExpected(settingsFile)
+	if err != nil && !os.IsNotExist(err) {
+		sensuutil.Exit("CONFIGERROR", fmt.Sprintf("Could not read %s: %v", settingsFile, err))
+	}
+
+	if len(definitions) == 0 && settings == nil {
+		sensuutil.Exit("CONFIGERROR", fmt.Sprintf("No definitions found in %s", dir))
+	}
+	return definitions, settings
+}
+
+// readExpected loads an expected definition.
+func readExpected(file string) (interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = json.Unmarshal(data, &v)
+	return v, err
+}
+
+// liveObject reads an object from the cluster. Objects that do not exist are returned as nil.
+func liveObject(ctx context.Context, client *elastic.Client, kind driftKind, name string) (interface{}, error) {
+	res, err := client.PerformRequest(ctx, "GET", kind.path(name), nil, nil, 404)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == 404 {
+		return nil, nil
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(res.Body, &body); err != nil {
+		return nil, err
+	}
+	return kind.live(body, name), nil
+}
+
+// byName picks the named object out of a response keyed by name.
+func byName(body map[string]interface{}, name string) interface{} {
+	return body[name]
+}
+
+// aliasIndices turns an alias response into the set of indices the alias points at.
+func aliasIndices(body map[string]interface{}, name string) interface{} {
+	indices := make(map[string]interface{})
+	for index := range body {
+		indices[index] = true
+	}
+	return map[string]interface{}{"indices": indices}
+}
+
+// expectedAliasIndices turns the list of indices in an expected alias definition into a set so the order the
+// indices are listed in does not matter.
+func expectedAliasIndices(v interface{}) interface{} {
+	def, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+	list, ok := def["indices"].([]interface{})
+	if !ok {
+		return v
+	}
+	indices := make(map[string]interface{})
+	for _, index := range list {
+		indices[fmt.Sprintf("%v", index)] = true
+	}
+	return map[string]interface{}{"indices": indices}
+}
+
+// explicitClusterSettings reads the persistent and transient cluster settings, leaving out the defaults.
+func explicitClusterSettings(ctx context.Context, client *elastic.Client) (map[string]interface{}, error) {
+	params := url.Values{"flat_settings": []string{"true"}}
+	res, err := client.PerformRequest(ctx, "GET", "/_cluster/settings", params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		Persistent map[string]interface{} `json:"persistent"`
+		Transient  map[string]interface{} `json:"transient"`
+	}
+	if err := json.Unmarshal(res.Body, &body); err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]interface{})
+	for _, layer := range []map[string]interface{}{body.Persistent, body.Transient} {
+		for k, v := range layer {
+			settings[k] = v
+		}
+	}
+	return settings, nil
+}
+
+// diffObjects compares every value in the expected definition with the live object and describes each difference,
+// including keys under the strict prefixes that the live object has but the definition does not.
+func diffObjects(name string, expected interface{}, live interface{}, strict []string) []string {
+	if live == nil {
+		return []string{fmt.Sprintf("%s: missing from the cluster", name)}
+	}
+
+	want := flatten(expected)
+	have := flatten(live)
+
+	var diffs []string
+	for _, k := range flatKeys(want) {
+		got, ok := have[k]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%s: %s expected %s, missing", name, k, want[k]))
+		case got != want[k]:
+			diffs = append(diffs, fmt.Sprintf("%s: %s expected %s, found %s", name, k, want[k], got))
+		}
+	}
+	return append(diffs, unexpectedKeys(name, want, have, strict)...)
+}
+
+// unexpectedKeys describes the keys under one of the prefixes that are in have but not in want.
+func unexpectedKeys(name string, want map[string]string, have map[string]string, prefixes []string) []string {
+	var diffs []string
+	for _, k := range flatKeys(have) {
+		if _, ok := want[k]; ok || !hasKeyPrefix(k, prefixes) {
+			continue
+		}
+		diffs = append(diffs, fmt.Sprintf("%s: %s not expected, found %s", name, k, have[k]))
+	}
+	return diffs
+}
+
+// hasKeyPrefix reports whether a dotted key is one of the prefixes or below one. An empty prefix matches every key.
+func hasKeyPrefix(key string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if p == "" || key == p || strings.HasPrefix(key, p+".") || strings.HasPrefix(key, p+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+// flatKeys returns the keys of a flattened definition in order.
+func flatKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flatten flattens a decoded JSON definition, see flattenDefinition.
+func flatten(v interface{}) map[string]string {
+	out := make(map[string]string)
+	flattenDefinition("", v, out)
+	return out
+}
+
+// flattenDefinition flattens a decoded JSON definition into dotted keys and string values so that settings given
+// as numbers or nested objects compare equal to the strings and flat names elasticsearch returns.
+func flattenDefinition(prefix string, v interface{}, out map[string]string) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			flattenDefinition(joinKey(prefix, k), child, out)
+		}
+	case []interface{}:
+		for i, child := range t {
+			flattenDefinition(fmt.Sprintf("%s[%d]", prefix, i), child, out)
+		}
+	case float64:
+		out[prefix] = strconv.FormatFloat(t, 'f', -1, 64)
+	case nil:
+		out[prefix] = "null"
+	default:
+		out[prefix] = fmt.Sprintf("%v", t)
+	}
+}
+
+// joinKey appends a key to a dotted prefix, dropping the redundant index. prefix elasticsearch puts on index
+// settings.
+func joinKey(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	if strings.HasSuffix(prefix, "settings") {
+		key = strings.TrimPrefix(key, "index.")
+		if key == "index" {
+			return prefix
+		}
+	}
+	return prefix + "." + key
+}
+
+func init() {
+	RootCmd.AddCommand(checkElasticsearchDriftCmd)
+
+	// set commandline flags
+	checkElasticsearchDriftCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	checkElasticsearchDriftCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	checkElasticsearchDriftCmd.Flags().StringVarP(&driftDir, "dir", "", "/etc/sensuplugins/elasticsearch", "the directory holding the expected definitions")
+}
@@ -0,0 +1,144 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+// index freshness configuration
+var indexFreshnessIndices []string
+var indexFreshnessQuery string
+var indexFreshnessTimestampField string
+var indexFreshnessGroupBy string
+var indexFreshnessGroupSize int
+var indexFreshnessWarn time.Duration
+var indexFreshnessCrit time.Duration
+
+// checkElasticsearchIndexFreshnessCmd alerts when the newest document in an index pattern is too old
+var checkElasticsearchIndexFreshnessCmd = &cobra.Command{
+	Use:   "checkElasticsearchIndexFreshness --indices <pattern> --timestamp-field <field> --warn <duration> --crit <duration>",
+	Short: "Alert when the newest document in an index pattern, optionally per source, is too old.",
+	Long: `When a log shipper silently stops sending nothing else notices. This will find the newest value of
+  --timestamp-field in --indices, optionally limited by --query, and alert when it is older than --warn
+  or --crit. With --group-by the newest document is found for each of the top terms of that field,
+  such as host, so a single source that stops shipping is caught. A zero threshold is disabled.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		client := checkEsClient()
+
+		newest := elastic.NewMaxAggregation().Field(indexFreshnessTimestampField)
+		search := client.Search(indexFreshnessIndices...).
+			Query(windowQuery(indexFreshnessQuery, "", indexFreshnessTimestampField, 0)).
+			Size(0)
+		if indexFreshnessGroupBy != "" {
+			// Order by the newest document so that when there are more groups than --group-size the stalest are kept.
+			group := elastic.NewTermsAggregation().Field(indexFreshnessGroupBy).Size(indexFreshnessGroupSize).
+				Order("newest", true).SubAggregation("newest", newest)
+			search = search.Aggregation("group", group)
+		} else {
+			search = search.Aggregation("newest", newest)
+		}
+		res, err := search.Do(context.Background())
+		if err != nil {
+			checkUnknown("Could not find the newest document", err)
+		}
+
+		now := time.Now()
+		pattern := strings.Join(indexFreshnessIndices, ",")
+		out := new(checkOutput)
+
+		if indexFreshnessGroupBy == "" {
+			age, ok := newestAge(res.Aggregations, now)
+			if !ok {
+				out.alert("CRITICAL", "no documents found")
+				out.exit("No documents in " + pattern)
+			}
+			out.alert(ageState(age), fmt.Sprintf("newest document is %s old", age))
+			out.perf("newest_age_seconds", int64(age.Seconds()))
+			out.exit(fmt.Sprintf("Newest document in %s is %s old", pattern, age))
+		}
+
+		groups, ok := res.Aggregations.Terms("group")
+		if !ok || len(groups.Buckets) == 0 {
+			out.alert("CRITICAL", "no documents found")
+			out.exit("No documents in " + pattern)
+		}
+		source := clusterSource(context.Background(), client)
+		for _, bucket := range groups.Buckets {
+			key := fmt.Sprintf("%v", bucket.Key)
+			age, ok := newestAge(bucket.Aggregations, now)
+			if !ok {
+				continue
+			}
+			out.alertFor(source, key, ageState(age), fmt.Sprintf("%s=%s is %s old", indexFreshnessGroupBy, key, age))
+			out.perfFor(source, key, "newest_age_seconds", int64(age.Seconds()))
+		}
+
+		out.exit(fmt.Sprintf("Newest document in %s for %d values of %s", pattern, len(groups.Buckets), indexFreshnessGroupBy))
+	},
+}
+
+// newestAge returns how long ago the newest document was written, truncated to the second.
+func newestAge(aggs elastic.Aggregations, now time.Time) (time.Duration, bool) {
+	newest, ok := aggs.Max("newest")
+	if !ok || newest.Value == nil {
+		return 0, false
+	}
+	written := time.Unix(0, int64(*newest.Value)*int64(time.Millisecond))
+	age := now.Sub(written)
+	return age - age%time.Second, true
+}
+
+// ageState compares the age of a document against the freshness thresholds.
+func ageState(age time.Duration) string {
+	switch {
+	case indexFreshnessCrit > 0 && age > indexFreshnessCrit:
+		return "CRITICAL"
+	case indexFreshnessWarn > 0 && age > indexFreshnessWarn:
+		return "WARNING"
+	default:
+		return "OK"
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(checkElasticsearchIndexFreshnessCmd)
+
+	// set commandline flags
+	checkElasticsearchIndexFreshnessCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	checkElasticsearchIndexFreshnessCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	checkElasticsearchIndexFreshnessCmd.Flags().StringSliceVarP(&indexFreshnessIndices, "indices", "", []string{"logstash-*"}, "the index pattern to inspect")
+	checkElasticsearchIndexFreshnessCmd.Flags().StringVarP(&indexFreshnessQuery, "query", "", "", "a lucene query string limiting the documents")
+	checkElasticsearchIndexFreshnessCmd.Flags().StringVarP(&indexFreshnessTimestampField, "timestamp-field", "", "@timestamp", "the field holding the document timestamp")
+	checkElasticsearchIndexFreshnessCmd.Flags().StringVarP(&indexFreshnessGroupBy, "group-by", "", "", "find the newest document for each of the top terms of this field")
+	checkElasticsearchIndexFreshnessCmd.Flags().IntVarP(&indexFreshnessGroupSize, "group-size", "", 100, "the number of terms to group by, the stalest are kept when there are more")
+	checkElasticsearchIndexFreshnessCmd.Flags().DurationVarP(&indexFreshnessWarn, "warn", "", 10*time.Minute, "warn when the newest document is older than this")
+	checkElasticsearchIndexFreshnessCmd.Flags().DurationVarP(&indexFreshnessCrit, "crit", "", 30*time.Minute, "critical when the newest document is older than this")
+	addSensuSocketFlags(checkElasticsearchIndexFreshnessCmd)
+}
@@ -0,0 +1,172 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+// jvm thresholds
+var jvmHeapWarn int
+var jvmHeapCrit int
+var jvmGCCountWarn float64
+var jvmGCCountCrit float64
+var jvmGCTimeWarn float64
+var jvmGCTimeCrit float64
+var jvmStateFile string
+
+// jvmGCState is the old generation collector totals of a node saved between runs.
+type jvmGCState struct {
+	Timestamp int64 `json:"timestamp"`
+	Count     int64 `json:"count"`
+	TimeMs    int64 `json:"time_ms"`
+}
+
+// checkElasticsearchJVMCmd alerts on heap and garbage collection pressure on every node
+var checkElasticsearchJVMCmd = &cobra.Command{
+	Use:   "checkElasticsearchJVM --host <host> --port <port> --heap-warn <percent> --heap-crit <percent>",
+	Short: "Alert when the heap usage or old generation garbage collection rate of any node is too high.",
+	Long: `This will read the jvm node stats and alert on any node whose heap used percent crosses --heap-warn
+  or --heap-crit. The old generation collection count and time are turned into per minute rates using
+  the totals saved in --state-file on the previous run, so the first run only records a baseline.
+  Unless --state-file is given the totals are kept per host and port. A negative threshold is
+  disabled.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		client := checkEsClient()
+		jvmStateFile = statePath(jvmStateFile, "jvm")
+
+		stats, err := client.NodesStats().Metric("jvm").Do(context.Background())
+		if err != nil {
+			checkUnknown("Could not read the node stats", err)
+		}
+
+		previous := make(map[string]jvmGCState)
+		readState(jvmStateFile, &previous)
+		current := make(map[string]jvmGCState)
+
+		out := new(checkOutput)
+		for _, id := range sortedNodeIDs(stats) {
+			node := stats.Nodes[id]
+			if node.JVM == nil || node.JVM.Mem == nil {
+				continue
+			}
+
+			heap := node.JVM.Mem.HeapUsedPercent
+			out.alertFor(node.Name, "", thresholdState(float64(heap), float64(jvmHeapWarn), float64(jvmHeapCrit), false),
+				fmt.Sprintf("%s heap %d%%", node.Name, heap))
+			out.perfFor(node.Name, "", "heap_used_percent", fmt.Sprintf("%d%%", heap))
+
+			old := oldGenCollector(node.JVM)
+			if old == nil {
+				continue
+			}
+			now := jvmGCState{Timestamp: node.JVM.Timestamp, Count: old.CollectionCount, TimeMs: old.CollectionTimeInMillis}
+			current[id] = now
+
+			last, ok := previous[id]
+			if !ok || now.Timestamp <= last.Timestamp || now.Count < last.Count {
+				// first run or the node restarted, there is nothing to compare against
+				continue
+			}
+			elapsed := time.Duration(now.Timestamp-last.Timestamp) * time.Millisecond
+			countRate := float64(now.Count-last.Count) / elapsed.Minutes()
+			timeRate := float64(now.TimeMs-last.TimeMs) / elapsed.Minutes()
+
+			out.alertFor(node.Name, "", thresholdState(countRate, jvmGCCountWarn, jvmGCCountCrit, false),
+				fmt.Sprintf("%s %.1f old gc/min", node.Name, countRate))
+			out.alertFor(node.Name, "", thresholdState(timeRate, jvmGCTimeWarn, jvmGCTimeCrit, false),
+				fmt.Sprintf("%s %.0fms old gc time/min", node.Name, timeRate))
+			out.perfFor(node.Name, "", "old_gc_per_minute", fmt.Sprintf("%.2f", countRate))
+			out.perfFor(node.Name, "", "old_gc_ms_per_minute", fmt.Sprintf("%.2f", timeRate))
+		}
+
+		if err := writeState(jvmStateFile, current); err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":     "sensupluginses",
+				"client":    host,
+				"error":     err,
+				"stateFile": jvmStateFile,
+			}).Error(`Could not save the jvm state`)
+		}
+
+		out.exit(fmt.Sprintf("JVM stats for %d nodes", len(stats.Nodes)))
+	},
+}
+
+// sortedNodeIDs returns the ids of the nodes in a stats response ordered by node name.
+func sortedNodeIDs(stats *elastic.NodesStatsResponse) []string {
+	nodeNames := make(map[string]string)
+	for id, node := range stats.Nodes {
+		nodeNames[id] = node.Name
+	}
+	return sortedIDsByName(nodeNames)
+}
+
+// sortedIDsByName orders node ids by the node names they map to, falling back to the id for nodes sharing a name.
+func sortedIDsByName(nodeNames map[string]string) []string {
+	byName := make(map[string]string)
+	var names []string
+	for id, name := range nodeNames {
+		key := name + "\x00" + id
+		byName[key] = id
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	ids := make([]string, 0, len(names))
+	for _, name := range names {
+		ids = append(ids, byName[name])
+	}
+	return ids
+}
+
+// oldGenCollector returns the old generation garbage collector of a node, if it reported one.
+func oldGenCollector(jvm *elastic.NodesStatsNodeJVM) *elastic.NodesStatsNodeJVMGCCollector {
+	if jvm.GC == nil {
+		return nil
+	}
+	return jvm.GC.Collectors["old"]
+}
+
+func init() {
+	RootCmd.AddCommand(checkElasticsearchJVMCmd)
+
+	// set commandline flags
+	checkElasticsearchJVMCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	checkElasticsearchJVMCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	checkElasticsearchJVMCmd.Flags().IntVarP(&jvmHeapWarn, "heap-warn", "", 85, "warn when heap used percent is above this")
+	checkElasticsearchJVMCmd.Flags().IntVarP(&jvmHeapCrit, "heap-crit", "", 95, "critical when heap used percent is above this")
+	checkElasticsearchJVMCmd.Flags().Float64VarP(&jvmGCCountWarn, "gc-count-warn", "", -1, "warn when old gc collections per minute are above this")
+	checkElasticsearchJVMCmd.Flags().Float64VarP(&jvmGCCountCrit, "gc-count-crit", "", -1, "critical when old gc collections per minute are above this")
+	checkElasticsearchJVMCmd.Flags().Float64VarP(&jvmGCTimeWarn, "gc-time-warn", "", -1, "warn when old gc milliseconds per minute are above this")
+	checkElasticsearchJVMCmd.Flags().Float64VarP(&jvmGCTimeCrit, "gc-time-crit", "", -1, "critical when old gc milliseconds per minute are above this")
+	checkElasticsearchJVMCmd.Flags().StringVarP(&jvmStateFile, "state-file", "", "", "where the gc totals are kept between runs (default jvm-<host>_<port>.json in "+DefaultStateDir+")")
+	addSensuSocketFlags(checkElasticsearchJVMCmd)
+}
@@ -0,0 +1,102 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yieldbot/sensuplugin/sensuutil"
+	"golang.org/x/net/context"
+)
+
+// query configuration
+var queryIndices []string
+var queryString string
+var queryJSON string
+var querySince time.Duration
+var queryTimestampField string
+var queryWarn float64
+var queryCrit float64
+var queryInvert bool
+
+// checkElasticsearchQueryCmd alerts on the number of documents matching a query
+var checkElasticsearchQueryCmd = &cobra.Command{
+	Use:   "checkElasticsearchQuery --indices <pattern> --query <query> --since <duration> --warn <n> --crit <n>",
+	Short: "Alert when the number of documents matching a query within a time window crosses a threshold.",
+	Long: `This will count the documents in --indices matching either a lucene query string given with --query
+  or a JSON query clause given with --query-json, limited to those whose --timestamp-field falls within
+  the last --since. The check alerts when the count is above --warn or --crit, or below them when
+  --invert is given. A negative threshold is disabled.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		if queryString != "" && queryJSON != "" {
+			sensuutil.Exit("CONFIGERROR", "Only one of --query and --query-json can be given")
+		}
+		clause, err := queryClause(queryJSON)
+		if err != nil {
+			sensuutil.Exit("CONFIGERROR", err.Error())
+		}
+
+		client := checkEsClient()
+
+		query := windowQuery(queryString, clause, queryTimestampField, querySince)
+		hits, err := client.Count(queryIndices...).Query(query).Do(context.Background())
+		if err != nil {
+			checkUnknown("Could not run the query", err)
+		}
+
+		direction := "more"
+		if queryInvert {
+			direction = "fewer"
+		}
+
+		out := new(checkOutput)
+		state := thresholdState(float64(hits), queryWarn, queryCrit, queryInvert)
+		threshold := queryWarn
+		if state == "CRITICAL" {
+			threshold = queryCrit
+		}
+		out.alert(state, fmt.Sprintf("%s hits than the %s threshold of %v", direction, strings.ToLower(state), threshold))
+		out.perf("hits", hits)
+
+		out.exit(fmt.Sprintf("%d hits in %s over the last %s", hits, strings.Join(queryIndices, ","), querySince))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(checkElasticsearchQueryCmd)
+
+	// set commandline flags
+	checkElasticsearchQueryCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	checkElasticsearchQueryCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	checkElasticsearchQueryCmd.Flags().StringSliceVarP(&queryIndices, "indices", "", []string{"logstash-*"}, "the index pattern to query")
+	checkElasticsearchQueryCmd.Flags().StringVarP(&queryString, "query", "", "", "a lucene query string")
+	checkElasticsearchQueryCmd.Flags().StringVarP(&queryJSON, "query-json", "", "", "a JSON query clause or search body with a query key, used instead of --query")
+	checkElasticsearchQueryCmd.Flags().DurationVarP(&querySince, "since", "", 5*time.Minute, "only count documents newer than this (0 disables)")
+	checkElasticsearchQueryCmd.Flags().StringVarP(&queryTimestampField, "timestamp-field", "", "@timestamp", "the field holding the document timestamp")
+	checkElasticsearchQueryCmd.Flags().Float64VarP(&queryWarn, "warn", "", -1, "warn when the hit count is above this")
+	checkElasticsearchQueryCmd.Flags().Float64VarP(&queryCrit, "crit", "", -1, "critical when the hit count is above this")
+	checkElasticsearchQueryCmd.Flags().BoolVarP(&queryInvert, "invert", "", false, "alert when the hit count is below the thresholds instead")
+}
@@ -0,0 +1,155 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+// rejection thresholds
+var rejectionThreadPools []string
+var rejectionBreakers []string
+var rejectionsWarn float64
+var rejectionsCrit float64
+var rejectionTripsWarn float64
+var rejectionTripsCrit float64
+var rejectionStateFile string
+
+// rejectionState is the thread pool rejection and breaker trip totals of a node saved between runs.
+type rejectionState struct {
+	Timestamp int64            `json:"timestamp"`
+	Rejected  map[string]int64 `json:"rejected"`
+	Tripped   map[string]int64 `json:"tripped"`
+}
+
+// checkElasticsearchRejectionsCmd alerts on thread pool rejections and circuit breaker trips
+var checkElasticsearchRejectionsCmd = &cobra.Command{
+	Use:   "checkElasticsearchRejections --host <host> --port <port> --thread-pools <pool,...>",
+	Short: "Alert when thread pool rejections or circuit breaker trips per minute are too high.",
+	Long: `Rejected bulk requests and tripped breakers fail quietly from the point of view of the cluster
+  health. This will read the thread pool and breaker node stats and compare them with the totals
+  saved in --state-file on the previous run, alerting when the rejections or trips per minute of any
+  node cross the thresholds. The first run, and the first run after a thread pool or breaker is added,
+  only records a baseline. Unless --state-file is given the totals are kept per host and port. A
+  negative threshold is disabled.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		client := checkEsClient()
+		rejectionStateFile = statePath(rejectionStateFile, "rejections")
+
+		stats, err := client.NodesStats().Metric("thread_pool", "breaker").Do(context.Background())
+		if err != nil {
+			checkUnknown("Could not read the node stats", err)
+		}
+
+		previous := make(map[string]rejectionState)
+		readState(rejectionStateFile, &previous)
+		current := make(map[string]rejectionState)
+
+		out := new(checkOutput)
+		for _, id := range sortedNodeIDs(stats) {
+			node := stats.Nodes[id]
+			now := rejectionState{Timestamp: node.Timestamp, Rejected: make(map[string]int64), Tripped: make(map[string]int64)}
+			for _, pool := range rejectionThreadPools {
+				if tp, ok := node.ThreadPool[pool]; ok {
+					now.Rejected[pool] = tp.Rejected
+				}
+			}
+			for name, breaker := range node.Breaker {
+				if len(rejectionBreakers) == 0 || containsString(rejectionBreakers, name) {
+					now.Tripped[name] = breaker.Tripped
+				}
+			}
+			current[id] = now
+
+			last, ok := previous[id]
+			if !ok || now.Timestamp <= last.Timestamp {
+				continue
+			}
+			elapsed := time.Duration(now.Timestamp-last.Timestamp) * time.Millisecond
+
+			for _, pool := range sortedKeys(now.Rejected) {
+				before, ok := last.Rejected[pool]
+				if !ok {
+					// the pool was not watched on the previous run, there is nothing to compare against
+					continue
+				}
+				rate := counterRate(now.Rejected[pool], before, elapsed)
+				out.alertFor(node.Name, "", thresholdState(rate, rejectionsWarn, rejectionsCrit, false),
+					fmt.Sprintf("%s %.1f %s rejections/min", node.Name, rate, pool))
+				out.perfFor(node.Name, "", perfLabel("thread_pool", pool, "rejected_per_minute"), fmt.Sprintf("%.2f", rate))
+			}
+			for _, name := range sortedKeys(now.Tripped) {
+				before, ok := last.Tripped[name]
+				if !ok {
+					continue
+				}
+				rate := counterRate(now.Tripped[name], before, elapsed)
+				out.alertFor(node.Name, "", thresholdState(rate, rejectionTripsWarn, rejectionTripsCrit, false),
+					fmt.Sprintf("%s %.1f %s breaker trips/min", node.Name, rate, name))
+				out.perfFor(node.Name, "", perfLabel("breaker", name, "tripped_per_minute"), fmt.Sprintf("%.2f", rate))
+			}
+		}
+
+		if err := writeState(rejectionStateFile, current); err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":     "sensupluginses",
+				"client":    host,
+				"error":     err,
+				"stateFile": rejectionStateFile,
+			}).Error(`Could not save the rejection state`)
+		}
+
+		out.exit(fmt.Sprintf("Rejections and breaker trips for %d nodes", len(stats.Nodes)))
+	},
+}
+
+// counterRate turns two readings of an ever increasing counter into a per minute rate. A counter that went
+// backwards was reset by a restart, so the current reading is the increase.
+func counterRate(current int64, last int64, elapsed time.Duration) float64 {
+	delta := current - last
+	if delta < 0 {
+		delta = current
+	}
+	return float64(delta) / elapsed.Minutes()
+}
+
+func init() {
+	RootCmd.AddCommand(checkElasticsearchRejectionsCmd)
+
+	// set commandline flags
+	checkElasticsearchRejectionsCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	checkElasticsearchRejectionsCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	checkElasticsearchRejectionsCmd.Flags().StringSliceVarP(&rejectionThreadPools, "thread-pools", "", []string{"bulk", "write", "search", "get"}, "the thread pools to watch for rejections")
+	checkElasticsearchRejectionsCmd.Flags().StringSliceVarP(&rejectionBreakers, "breakers", "", nil, "the circuit breakers to watch for trips (default all)")
+	checkElasticsearchRejectionsCmd.Flags().Float64VarP(&rejectionsWarn, "rejections-warn", "", 0, "warn when rejections per minute are above this")
+	checkElasticsearchRejectionsCmd.Flags().Float64VarP(&rejectionsCrit, "rejections-crit", "", 10, "critical when rejections per minute are above this")
+	checkElasticsearchRejectionsCmd.Flags().Float64VarP(&rejectionTripsWarn, "trips-warn", "", -1, "warn when breaker trips per minute are above this")
+	checkElasticsearchRejectionsCmd.Flags().Float64VarP(&rejectionTripsCrit, "trips-crit", "", 0, "critical when breaker trips per minute are above this")
+	checkElasticsearchRejectionsCmd.Flags().StringVarP(&rejectionStateFile, "state-file", "", "", "where the rejection totals are kept between runs (default rejections-<host>_<port>.json in "+DefaultStateDir+")")
+	addSensuSocketFlags(checkElasticsearchRejectionsCmd)
+}
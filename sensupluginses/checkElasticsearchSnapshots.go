@@ -0,0 +1,185 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"github.com/yieldbot/sensuplugin/sensuutil"
+	"golang.org/x/net/context"
+)
+
+// snapshot configuration
+var snapshotRepository string
+var snapshotWarn time.Duration
+var snapshotCrit time.Duration
+
+// snapshotInfo holds the fields of a snapshot listing needed to judge it.
+type snapshotInfo struct {
+	Snapshot          string `json:"snapshot"`
+	State             string `json:"state"`
+	StartTimeInMillis int64  `json:"start_time_in_millis"`
+	EndTimeInMillis   int64  `json:"end_time_in_millis"`
+	DurationInMillis  int64  `json:"duration_in_millis"`
+}
+
+// snapshotsByStart sorts snapshots from oldest to newest.
+type snapshotsByStart []snapshotInfo
+
+func (a snapshotsByStart) Len() int           { return len(a) }
+func (a snapshotsByStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a snapshotsByStart) Less(i, j int) bool { return a[i].StartTimeInMillis < a[j].StartTimeInMillis }
+
+// checkElasticsearchSnapshotsCmd alerts on stale or failed snapshots
+var checkElasticsearchSnapshotsCmd = &cobra.Command{
+	Use:   "checkElasticsearchSnapshots --repository <repository> --warn <duration> --crit <duration>",
+	Short: "Alert when the last successful snapshot is too old or the last snapshot failed.",
+	Long: `This will list the snapshots in --repository and alert when the most recent successful snapshot is
+  older than --warn or --crit. The most recent finished snapshot is critical when it FAILED and a
+  warning when it is PARTIAL. The duration and size of the last successful snapshot are reported as
+  perfdata.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		if snapshotRepository == "" {
+			sensuutil.Exit("CONFIGERROR", "--repository is required")
+		}
+
+		client := checkEsClient()
+		ctx := context.Background()
+
+		snapshots, err := listSnapshots(ctx, client)
+		if err != nil {
+			checkUnknown("Could not list the snapshots in "+snapshotRepository, err)
+		}
+		sort.Sort(snapshotsByStart(snapshots))
+
+		out := new(checkOutput)
+		var lastFinished, lastSuccess *snapshotInfo
+		for i := range snapshots {
+			if snapshots[i].State == "IN_PROGRESS" {
+				continue
+			}
+			lastFinished = &snapshots[i]
+			if snapshots[i].State == "SUCCESS" {
+				lastSuccess = &snapshots[i]
+			}
+		}
+
+		if lastFinished != nil {
+			switch lastFinished.State {
+			case "FAILED":
+				out.alert("CRITICAL", "snapshot "+lastFinished.Snapshot+" FAILED")
+			case "PARTIAL":
+				out.alert("WARNING", "snapshot "+lastFinished.Snapshot+" is PARTIAL")
+			}
+		}
+
+		if lastSuccess == nil {
+			out.alert("CRITICAL", "no successful snapshot found")
+			out.exit("Snapshots in " + snapshotRepository)
+		}
+
+		finished := time.Unix(0, lastSuccess.EndTimeInMillis*int64(time.Millisecond))
+		age := time.Since(finished)
+		age -= age % time.Second
+		state := "OK"
+		switch {
+		case snapshotCrit > 0 && age > snapshotCrit:
+			state = "CRITICAL"
+		case snapshotWarn > 0 && age > snapshotWarn:
+			state = "WARNING"
+		}
+		out.alert(state, fmt.Sprintf("last successful snapshot is %s old", age))
+
+		out.perf("last_success_age_seconds", int64(age.Seconds()))
+		out.perf("duration_seconds", lastSuccess.DurationInMillis/1000)
+		if size, err := snapshotSize(ctx, client, lastSuccess.Snapshot); err == nil {
+			out.perf("size", fmt.Sprintf("%dB", size))
+		}
+
+		out.exit(fmt.Sprintf("Last successful snapshot in %s is %s", snapshotRepository, lastSuccess.Snapshot))
+	},
+}
+
+// listSnapshots returns every snapshot in the repository.
+func listSnapshots(ctx context.Context, client *elastic.Client) ([]snapshotInfo, error) {
+	res, err := client.PerformRequest(ctx, "GET", "/_snapshot/"+snapshotRepository+"/_all", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		Snapshots []snapshotInfo `json:"snapshots"`
+	}
+	if err := json.Unmarshal(res.Body, &body); err != nil {
+		return nil, err
+	}
+	return body.Snapshots, nil
+}
+
+// snapshotSize returns the total size of a snapshot in bytes.
+func snapshotSize(ctx context.Context, client *elastic.Client, snapshot string) (int64, error) {
+	path := "/_snapshot/" + snapshotRepository + "/" + snapshot + "/_status"
+	res, err := client.PerformRequest(ctx, "GET", path, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var body struct {
+		Snapshots []struct {
+			Stats struct {
+				TotalSizeInBytes int64 `json:"total_size_in_bytes"`
+				Total            struct {
+					SizeInBytes int64 `json:"size_in_bytes"`
+				} `json:"total"`
+			} `json:"stats"`
+		} `json:"snapshots"`
+	}
+	if err := json.Unmarshal(res.Body, &body); err != nil {
+		return 0, err
+	}
+	if len(body.Snapshots) == 0 {
+		return 0, fmt.Errorf("no status for snapshot %s", snapshot)
+	}
+
+	stats := body.Snapshots[0].Stats
+	if stats.TotalSizeInBytes > 0 {
+		return stats.TotalSizeInBytes, nil
+	}
+	return stats.Total.SizeInBytes, nil
+}
+
+func init() {
+	RootCmd.AddCommand(checkElasticsearchSnapshotsCmd)
+
+	// set commandline flags
+	checkElasticsearchSnapshotsCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	checkElasticsearchSnapshotsCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	checkElasticsearchSnapshotsCmd.Flags().StringVarP(&snapshotRepository, "repository", "", "", "the snapshot repository to inspect")
+	checkElasticsearchSnapshotsCmd.Flags().DurationVarP(&snapshotWarn, "warn", "", 26*time.Hour, "warn when the last successful snapshot is older than this")
+	checkElasticsearchSnapshotsCmd.Flags().DurationVarP(&snapshotCrit, "crit", "", 50*time.Hour, "critical when the last successful snapshot is older than this")
+}
@@ -0,0 +1,129 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"github.com/yieldbot/sensuplugin/sensuutil"
+	"golang.org/x/net/context"
+)
+
+// freshness thresholds, as multiples of the check interval
+var freshnessWarn int
+var freshnessCrit int
+
+// staleCheck is a status document that has not been updated in time.
+type staleCheck struct {
+	name string
+	age  time.Duration
+	crit bool
+}
+
+// checkElasticsearchStatusFreshnessCmd alerts on check results that have stopped arriving
+var checkElasticsearchStatusFreshnessCmd = &cobra.Command{
+	Use:   "checkElasticsearchStatusFreshness --index <index> --warn <n> --crit <n>",
+	Short: "Alert on status documents that have not been updated within a number of check intervals.",
+	Long: `A check result that stops arriving leaves its last status in the index and looks perfectly
+  healthy on a dashboard. This will look at every status document and alert when it has not been
+  updated within --warn or --crit times its check interval, catching dead sensu clients and broken
+  handlers. Documents that do not carry a check_interval are ignored. Handlers using --write-mode
+  on-change leave steady documents unwritten, so pair it with on-change-or-every=<duration> instead.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		client := checkEsClient()
+
+		now := time.Now()
+		var stale []staleCheck
+		total := 0
+
+		err := eachStatusDocument(context.Background(), client, func(hit *elastic.SearchHit, doc statusDocument) error {
+			total++
+			age, ok := statusDocumentAge(doc, now)
+			if !ok || doc.CheckInterval <= 0 {
+				return nil
+			}
+
+			interval := time.Duration(doc.CheckInterval) * time.Second
+			switch {
+			case freshnessCrit > 0 && age > time.Duration(freshnessCrit)*interval:
+				stale = append(stale, staleCheck{name: hit.Id, age: age, crit: true})
+			case freshnessWarn > 0 && age > time.Duration(freshnessWarn)*interval:
+				stale = append(stale, staleCheck{name: hit.Id, age: age})
+			}
+			return nil
+		})
+		if err != nil {
+			checkUnknown("Could not read the status documents in "+esIndex, err)
+		}
+
+		if len(stale) == 0 {
+			sensuutil.Exit("OK", fmt.Sprintf("All %d status documents in %s are current", total, esIndex))
+		}
+
+		state := "WARNING"
+		for _, s := range stale {
+			if s.crit {
+				state = "CRITICAL"
+			}
+		}
+		sensuutil.Exit(state, fmt.Sprintf("%d of %d status documents in %s are stale: %s", len(stale), total, esIndex, describeStaleChecks(stale)))
+	},
+}
+
+// byAge sorts stale checks from oldest to newest.
+type byAge []staleCheck
+
+func (a byAge) Len() int           { return len(a) }
+func (a byAge) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAge) Less(i, j int) bool { return a[i].age > a[j].age }
+
+// describeStaleChecks lists the oldest of the stale checks for the check output.
+func describeStaleChecks(stale []staleCheck) string {
+	sort.Sort(byAge(stale))
+
+	var names []string
+	for i, s := range stale {
+		if i == 10 {
+			names = append(names, fmt.Sprintf("and %d more", len(stale)-i))
+			break
+		}
+		names = append(names, fmt.Sprintf("%s (%s)", s.name, s.age-s.age%time.Second))
+	}
+	return strings.Join(names, ", ")
+}
+
+func init() {
+	RootCmd.AddCommand(checkElasticsearchStatusFreshnessCmd)
+
+	// set commandline flags
+	checkElasticsearchStatusFreshnessCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	checkElasticsearchStatusFreshnessCmd.Flags().StringVarP(&esIndex, "index", "", StatusEsIndex, "the es status index to inspect")
+	checkElasticsearchStatusFreshnessCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	checkElasticsearchStatusFreshnessCmd.Flags().IntVarP(&freshnessWarn, "warn", "", 3, "warn when a document is older than this many check intervals")
+	checkElasticsearchStatusFreshnessCmd.Flags().IntVarP(&freshnessCrit, "crit", "", 5, "critical when a document is older than this many check intervals")
+}
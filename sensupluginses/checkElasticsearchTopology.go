@@ -0,0 +1,234 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+// topology expectations
+var topologyMasterNodes int
+var topologyDataNodes int
+var topologyIngestNodes int
+var topologyStateFile string
+
+// topologyNode holds the fields of the nodes info needed to check the topology. The vendored client does not
+// decode the roles or the jvm version correctly so the response is read directly.
+type topologyNode struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Roles   []string `json:"roles"`
+	JVM     struct {
+		Version string `json:"version"`
+	} `json:"jvm"`
+	HTTP struct {
+		PublishAddress string `json:"publish_address"`
+	} `json:"http"`
+}
+
+// topologyState is the elected master saved between runs.
+type topologyState struct {
+	MasterID   string `json:"master_id"`
+	MasterName string `json:"master_name"`
+}
+
+// checkElasticsearchTopologyCmd alerts on unexpected node counts, master disagreement and mixed versions
+var checkElasticsearchTopologyCmd = &cobra.Command{
+	Use:   "checkElasticsearchTopology --host <host> --port <port> --master-nodes <n> --data-nodes <n> --ingest-nodes <n>",
+	Short: "Alert on unexpected node counts per role, master disagreement, master changes and mixed versions.",
+	Long: `This will count the nodes with each role and compare them to --master-nodes, --data-nodes and
+  --ingest-nodes, going critical when there are fewer and warning when there are more. Every node is
+  asked which master it follows and any disagreement, a sign of split brain, is critical. Mixed
+  elasticsearch or jvm versions, such as a rolling upgrade left half way, and a master that changed
+  since the previous run recorded in --state-file, by default kept per host and port, are warnings.
+  A negative expectation is disabled.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		client := checkEsClient()
+		topologyStateFile = statePath(topologyStateFile, "topology")
+		ctx := context.Background()
+
+		nodes, err := topologyNodes(ctx, client)
+		if err != nil {
+			checkUnknown("Could not read the nodes info", err)
+		}
+		state, err := client.ClusterState().Metric("master_node").Do(ctx)
+		if err != nil {
+			checkUnknown("Could not read the cluster state", err)
+		}
+
+		out := new(checkOutput)
+
+		counts := make(map[string]int)
+		esVersions := make(map[string]bool)
+		jvmVersions := make(map[string]bool)
+		nodeNames := make(map[string]string)
+		for id, node := range nodes {
+			for _, role := range node.Roles {
+				counts[role]++
+			}
+			esVersions[node.Version] = true
+			jvmVersions[node.JVM.Version] = true
+			nodeNames[id] = node.Name
+		}
+
+		expectations := []struct {
+			role     string
+			expected int
+		}{
+			{"master", topologyMasterNodes},
+			{"data", topologyDataNodes},
+			{"ingest", topologyIngestNodes},
+		}
+		for _, e := range expectations {
+			role, expected := e.role, e.expected
+			switch {
+			case expected < 0 || counts[role] == expected:
+			case counts[role] < expected:
+				out.alert("CRITICAL", fmt.Sprintf("%d %s nodes, expected %d", counts[role], role, expected))
+			default:
+				out.alert("WARNING", fmt.Sprintf("%d %s nodes, expected %d", counts[role], role, expected))
+			}
+			out.perf(role+"_nodes", counts[role])
+		}
+
+		if len(esVersions) > 1 {
+			out.alert("WARNING", "mixed elasticsearch versions "+strings.Join(sortedSet(esVersions), ", "))
+		}
+		if len(jvmVersions) > 1 {
+			out.alert("WARNING", "mixed jvm versions "+strings.Join(sortedSet(jvmVersions), ", "))
+		}
+
+		for _, id := range sortedIDsByName(nodeNames) {
+			node := nodes[id]
+			if node.HTTP.PublishAddress == "" {
+				continue
+			}
+			master, err := localMaster(node.HTTP.PublishAddress)
+			switch {
+			case err != nil:
+				out.alertFor(node.Name, "", "WARNING", fmt.Sprintf("could not ask %s for its master: %v", node.Name, err))
+			case master != state.MasterNode:
+				out.alertFor(node.Name, "", "CRITICAL", fmt.Sprintf("%s follows master %s instead of %s", node.Name, masterName(nodes, master), masterName(nodes, state.MasterNode)))
+			default:
+				out.alertFor(node.Name, "", "OK", fmt.Sprintf("%s follows master %s", node.Name, masterName(nodes, master)))
+			}
+		}
+
+		current := topologyState{MasterID: state.MasterNode, MasterName: masterName(nodes, state.MasterNode)}
+		var previous topologyState
+		if readState(topologyStateFile, &previous) && previous.MasterID != "" && previous.MasterID != current.MasterID {
+			out.alert("WARNING", fmt.Sprintf("master changed from %s to %s", previous.MasterName, current.MasterName))
+		}
+		if err := writeState(topologyStateFile, current); err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":     "sensupluginses",
+				"client":    host,
+				"error":     err,
+				"stateFile": topologyStateFile,
+			}).Error(`Could not save the topology state`)
+		}
+
+		out.perf("nodes", len(nodes))
+		out.exit(fmt.Sprintf("%d nodes with master %s", len(nodes), current.MasterName))
+	},
+}
+
+// topologyNodes reads the nodes info keyed by node id.
+func topologyNodes(ctx context.Context, client *elastic.Client) (map[string]topologyNode, error) {
+	res, err := client.PerformRequest(ctx, "GET", "/_nodes/jvm,http", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var body struct {
+		Nodes map[string]topologyNode `json:"nodes"`
+	}
+	err = json.Unmarshal(res.Body, &body)
+	return body.Nodes, err
+}
+
+// localMaster asks a single node which master it currently follows. The address is a publish address, which names
+// the host in front of the ip when it was published by name, as in host/10.0.0.1:9200.
+func localMaster(address string) (string, error) {
+	if i := strings.LastIndex(address, "/"); i >= 0 {
+		address = address[i+1:]
+	}
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	res, err := httpClient.Get("http://" + address + "/_cluster/state/master_node?local=true")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", res.Status)
+	}
+	var body struct {
+		MasterNode string `json:"master_node"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	return body.MasterNode, err
+}
+
+// masterName returns the name of a node, falling back to its id when it is not part of the cluster.
+func masterName(nodes map[string]topologyNode, id string) string {
+	if node, ok := nodes[id]; ok {
+		return node.Name
+	}
+	if id == "" {
+		return "none"
+	}
+	return id
+}
+
+// sortedSet returns the members of a set in order.
+func sortedSet(set map[string]bool) []string {
+	members := make([]string, 0, len(set))
+	for m := range set {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func init() {
+	RootCmd.AddCommand(checkElasticsearchTopologyCmd)
+
+	// set commandline flags
+	checkElasticsearchTopologyCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	checkElasticsearchTopologyCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	checkElasticsearchTopologyCmd.Flags().IntVarP(&topologyMasterNodes, "master-nodes", "", -1, "the expected number of master eligible nodes")
+	checkElasticsearchTopologyCmd.Flags().IntVarP(&topologyDataNodes, "data-nodes", "", -1, "the expected number of data nodes")
+	checkElasticsearchTopologyCmd.Flags().IntVarP(&topologyIngestNodes, "ingest-nodes", "", -1, "the expected number of ingest nodes")
+	checkElasticsearchTopologyCmd.Flags().StringVarP(&topologyStateFile, "state-file", "", "", "where the elected master is kept between runs (default topology-<host>_<port>.json in "+DefaultStateDir+")")
+	addSensuSocketFlags(checkElasticsearchTopologyCmd)
+}
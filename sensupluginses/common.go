@@ -1,4 +1,4 @@
-// Library for all constants used by the elasticsearch sensu packages
+// Library for all constants and types used by the elasticsearch sensu packages
 //
 // LICENSE:
 //   Copyright 2015 Yieldbot. <devops@yieldbot.com>
@@ -9,8 +9,71 @@ package sensupluginses
 
 // Default values for connecting with and indexing Elasticsearch.
 const (
-	DefaultEsType string = "sensu"
-	DefaultEsPort string = "9200"
-	StatusEsIndex string = "monitoring-status"
-	DefaultEsHost string = "localhost"
+	DefaultEsType    string = "sensu"
+	DefaultEsPort    string = "9200"
+	StatusEsIndex    string = "monitoring-status"
+	DefaultEsHost    string = "localhost"
+	CanaryEsIndex    string = "sensu-canary"
+	IncidentsEsIndex string = "monitoring-incidents"
 )
+
+// DefaultSensuSocket is the address of the local sensu client socket.
+const DefaultSensuSocket string = "localhost:3030"
+
+// DefaultStateDir holds the state files checks keep between runs.
+const DefaultStateDir string = "/var/tmp/sensupluginses"
+
+// Status document id templates. The legacy template is what the handler used before ids became configurable; it
+// is the same as the default for everything but proxy checks.
+const (
+	DefaultIDTemplate string = "{{.Instance}}_{{.Check}}"
+	LegacyIDTemplate  string = "{{.Client}}_{{.Check}}"
+)
+
+// statusDocument holds the fields of a status document needed to judge how
+// current it is.
+type statusDocument struct {
+	MonitoredInstance string   `json:"monitored_instance"`
+	SensuClient       string   `json:"sensu_client"`
+	CheckName         string   `json:"check_name"`
+	CheckState        string   `json:"check_state"`
+	IncidentTimestamp string   `json:"incident_timestamp"`
+	CheckInterval     int      `json:"check_interval"`
+	IncidentID        string   `json:"incident_id,omitempty"`
+	FirstSeen         string   `json:"first_seen,omitempty"`
+	Tags              []string `json:"tags"`
+}
+
+// stateSeverity orders the sensu check states from best to worst so results can be combined.
+var stateSeverity = map[string]int{
+	"OK":       0,
+	"UNKNOWN":  1,
+	"WARNING":  2,
+	"CRITICAL": 3,
+}
+
+// checkOutput collects the state, messages and perfdata of a check before it exits. Results about a single node or
+// index are kept apart in entities so they can be sent to the sensu client socket on their own.
+type checkOutput struct {
+	state    string
+	messages []string
+	perfData []string
+	entities []*entityResult
+}
+
+// entityResult is the result of a check for a single node, index or bucket.
+type entityResult struct {
+	source   string
+	name     string
+	state    string
+	messages []string
+	perfData []string
+}
+
+// sensuResult is a check result as accepted by the sensu client socket.
+type sensuResult struct {
+	Name   string `json:"name"`
+	Output string `json:"output"`
+	Status int    `json:"status"`
+	Source string `json:"source,omitempty"`
+}
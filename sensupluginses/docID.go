@@ -0,0 +1,152 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/yieldbot/sensuplugin/sensuhandler"
+)
+
+// document id configuration
+var idTemplateFlag string
+var idHashOver int
+
+// docIDFields are the values available to a document id template.
+type docIDFields struct {
+	Client     string
+	Source     string
+	Instance   string
+	Check      string
+	Env        string
+	Datacenter string
+}
+
+// docIDTemplate renders status document ids. Ids longer than hashOver bytes are replaced by their sha1 so that long
+// proxy names never exceed what elasticsearch accepts.
+type docIDTemplate struct {
+	text     string
+	tmpl     *template.Template
+	hashOver int
+}
+
+// docIDFuncs are the functions available to a document id template.
+var docIDFuncs = template.FuncMap{
+	"hash":  hashID,
+	"lower": strings.ToLower,
+}
+
+// hashID returns the hex sha1 of s.
+func hashID(s string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(s)))
+}
+
+// parseDocIDTemplate parses an id template and makes sure it renders.
+func parseDocIDTemplate(text string, hashOver int) (*docIDTemplate, error) {
+	tmpl, err := template.New("id").Funcs(docIDFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id template %q: %v", text, err)
+	}
+	t := &docIDTemplate{text: text, tmpl: tmpl, hashOver: hashOver}
+	if _, err := t.render(docIDFields{Client: "client", Instance: "client", Check: "check"}); err != nil {
+		return nil, fmt.Errorf("invalid id template %q: %v", text, err)
+	}
+	return t, nil
+}
+
+// loadDocIDTemplate reads the id template from the flags and the id_template key of the config file. Flags given
+// on the commandline take precedence over the config file.
+func loadDocIDTemplate(flags *pflag.FlagSet) (*docIDTemplate, error) {
+	text := idTemplateFlag
+	if !flags.Changed("id-template") && viper.IsSet("id_template") {
+		text = viper.GetString("id_template")
+	}
+	hashOver := idHashOver
+	if !flags.Changed("id-hash-over") && viper.IsSet("id_hash_over") {
+		hashOver = viper.GetInt("id_hash_over")
+	}
+	return parseDocIDTemplate(text, hashOver)
+}
+
+// render builds the id for the given fields.
+func (t *docIDTemplate) render(f docIDFields) (string, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, f); err != nil {
+		return "", err
+	}
+	id := buf.String()
+	if id == "" {
+		return "", fmt.Errorf("the id template rendered an empty id")
+	}
+	if t.hashOver > 0 && len(id) > t.hashOver {
+		id = hashID(id)
+	}
+	return id, nil
+}
+
+// eventIDFields collects the id template values of an event.
+func eventIDFields(event *sensuhandler.SensuEvent, env *sensuhandler.EnvDetails) docIDFields {
+	f := docIDFields{
+		Client:   event.Client.Name,
+		Source:   event.Check.Source,
+		Instance: event.AcquireMonitoredInstance(),
+		Check:    event.Check.Name,
+		Env:      event.Client.Environment,
+	}
+	if env != nil {
+		if f.Env == "" {
+			f.Env = env.Sensu.Environment
+		}
+		f.Datacenter = env.Sensu.Consul.Datacenter
+	}
+	return f
+}
+
+// eventID renders the id of the status document for an event. Should the template fail for this event, for
+// instance by rendering nothing, the legacy id is used rather than losing the document.
+func (t *docIDTemplate) eventID(event *sensuhandler.SensuEvent, env *sensuhandler.EnvDetails) string {
+	id, err := t.render(eventIDFields(event, env))
+	if err != nil {
+		syslogLog.WithFields(logrus.Fields{
+			"check":      "sensupluginses",
+			"client":     host,
+			"error":      err,
+			"idTemplate": t.text,
+			"sensuCheck": event.Check.Name,
+		}).Error(`Could not render the document id, using the legacy id`)
+		return sensuhandler.EventName(event.Client.Name, event.Check.Name)
+	}
+	return id
+}
+
+// addDocIDFlags adds the flags that control how status document ids are built.
+func addDocIDFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&idTemplateFlag, "id-template", "", DefaultIDTemplate, "the template status document ids are built from")
+	cmd.Flags().IntVarP(&idHashOver, "id-hash-over", "", 512, "replace ids longer than this many bytes by their sha1 (0 disables)")
+}
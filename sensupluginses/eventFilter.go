@@ -0,0 +1,235 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/yieldbot/sensuplugin/sensuhandler"
+)
+
+// event filter configuration
+var filterIncludeTags []string
+var filterExcludeTags []string
+var filterIncludeSubscriptions []string
+var filterExcludeSubscriptions []string
+var filterIncludeEnvs []string
+var filterExcludeEnvs []string
+var filterCheckRegex string
+var filterExcludeCheckRegex string
+var filterStatuses []string
+var filterMinOccurrences int
+var filterRefresh time.Duration
+
+// eventFilter decides which events are written to elasticsearch. Empty include lists match everything.
+type eventFilter struct {
+	includeTags          []string
+	excludeTags          []string
+	includeSubscriptions []string
+	excludeSubscriptions []string
+	includeEnvs          []string
+	excludeEnvs          []string
+	checkName            *regexp.Regexp
+	excludeCheckName     *regexp.Regexp
+	statuses             []int
+	minOccurrences       int
+	refresh              time.Duration
+}
+
+// statusCodes maps the names accepted by --status to sensu check statuses.
+var statusCodes = map[string]int{
+	"ok":       0,
+	"warning":  1,
+	"critical": 2,
+	"unknown":  3,
+}
+
+// loadEventFilter builds the event filter from the flags and the filter section of the config file. Flags given
+// on the commandline take precedence over the config file.
+func loadEventFilter(flags *pflag.FlagSet) (*eventFilter, error) {
+	list := func(flag string, key string, value []string) []string {
+		if !flags.Changed(flag) && viper.IsSet(key) {
+			return viper.GetStringSlice(key)
+		}
+		return value
+	}
+	str := func(flag string, key string, value string) string {
+		if !flags.Changed(flag) && viper.IsSet(key) {
+			return viper.GetString(key)
+		}
+		return value
+	}
+
+	f := &eventFilter{
+		includeTags:          list("include-tag", "filter.include_tags", filterIncludeTags),
+		excludeTags:          list("exclude-tag", "filter.exclude_tags", filterExcludeTags),
+		includeSubscriptions: list("include-subscription", "filter.include_subscriptions", filterIncludeSubscriptions),
+		excludeSubscriptions: list("exclude-subscription", "filter.exclude_subscriptions", filterExcludeSubscriptions),
+		includeEnvs:          list("include-env", "filter.include_environments", filterIncludeEnvs),
+		excludeEnvs:          list("exclude-env", "filter.exclude_environments", filterExcludeEnvs),
+		minOccurrences:       filterMinOccurrences,
+		refresh:              filterRefresh,
+	}
+	if !flags.Changed("min-occurrences") && viper.IsSet("filter.min_occurrences") {
+		f.minOccurrences = viper.GetInt("filter.min_occurrences")
+	}
+	if !flags.Changed("refresh") && viper.IsSet("filter.refresh") {
+		f.refresh = viper.GetDuration("filter.refresh")
+	}
+
+	var err error
+	if pattern := str("check-regex", "filter.check_name", filterCheckRegex); pattern != "" {
+		if f.checkName, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid check name pattern %q: %v", pattern, err)
+		}
+	}
+	if pattern := str("exclude-check-regex", "filter.exclude_check_name", filterExcludeCheckRegex); pattern != "" {
+		if f.excludeCheckName, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid check name pattern %q: %v", pattern, err)
+		}
+	}
+	for _, s := range list("status", "filter.statuses", filterStatuses) {
+		code, ok := statusCodes[strings.ToLower(s)]
+		if !ok {
+			if code, err = strconv.Atoi(s); err != nil {
+				return nil, fmt.Errorf("invalid status %q, expected ok, warning, critical, unknown or a number", s)
+			}
+		}
+		f.statuses = append(f.statuses, code)
+	}
+	return f, nil
+}
+
+// allow reports whether an event should be written. When it should not the reason is returned as well. Resolutions
+// always pass so a check that was written while failing is never left in a failed state.
+func (f *eventFilter) allow(event *sensuhandler.SensuEvent, env *sensuhandler.EnvDetails) (bool, string) {
+	if event.Action == "resolve" {
+		return true, ""
+	}
+	if len(f.includeTags) > 0 && !containsAny(event.Check.Tags, f.includeTags) {
+		return false, "no included tag"
+	}
+	if containsAny(event.Check.Tags, f.excludeTags) {
+		return false, "excluded tag"
+	}
+	if len(f.includeSubscriptions) > 0 && !containsAny(event.Client.Subscriptions, f.includeSubscriptions) {
+		return false, "no included subscription"
+	}
+	if containsAny(event.Client.Subscriptions, f.excludeSubscriptions) {
+		return false, "excluded subscription"
+	}
+
+	environment := event.Client.Environment
+	if environment == "" && env != nil {
+		environment = env.Sensu.Environment
+	}
+	if len(f.includeEnvs) > 0 && !containsString(f.includeEnvs, environment) {
+		return false, "environment not included"
+	}
+	if containsString(f.excludeEnvs, environment) {
+		return false, "excluded environment"
+	}
+
+	if f.checkName != nil && !f.checkName.MatchString(event.Check.Name) {
+		return false, "check name not matched"
+	}
+	if f.excludeCheckName != nil && f.excludeCheckName.MatchString(event.Check.Name) {
+		return false, "excluded check name"
+	}
+	if len(f.statuses) > 0 && !containsInt(f.statuses, event.Check.Status) {
+		return false, "status not included"
+	}
+	return f.allowOccurrence(event)
+}
+
+// allowOccurrence applies the occurrence and refresh rules the way the sensu occurrences filter does: an event
+// passes once it has occurred the minimum number of times and then once per refresh interval.
+func (f *eventFilter) allowOccurrence(event *sensuhandler.SensuEvent) (bool, string) {
+	if event.Occurrences < f.minOccurrences {
+		return false, "too few occurrences"
+	}
+	if f.refresh <= 0 || event.Check.Interval <= 0 {
+		return true, ""
+	}
+
+	first := f.minOccurrences
+	if first < 1 {
+		first = 1
+	}
+	every := int(f.refresh.Seconds()) / event.Check.Interval
+	if every > 1 && (event.Occurrences-first)%every != 0 {
+		return false, "within the refresh interval"
+	}
+	return true, ""
+}
+
+// silentAfter returns how long a check may go without an event getting past the filter before it counts as silent:
+// two check intervals on top of what the occurrence and refresh rules may hold back. It returns 0, which turns
+// silence detection off, when the check interval is not known or the filter drops whole states.
+func (f *eventFilter) silentAfter(interval int) time.Duration {
+	if interval <= 0 || len(f.statuses) > 0 {
+		return 0
+	}
+	every := time.Duration(interval) * time.Second
+	return 2*every + time.Duration(f.minOccurrences)*every + f.refresh
+}
+
+// containsAny reports whether any of wanted is in list.
+func containsAny(list []string, wanted []string) bool {
+	for _, s := range wanted {
+		if containsString(list, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsInt reports whether i is in list.
+func containsInt(list []int, i int) bool {
+	for _, v := range list {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
+
+// addEventFilterFlags adds the flags that select which events are written.
+func addEventFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVarP(&filterIncludeTags, "include-tag", "", nil, "only write events of checks with one of these tags")
+	cmd.Flags().StringSliceVarP(&filterExcludeTags, "exclude-tag", "", nil, "drop events of checks with any of these tags")
+	cmd.Flags().StringSliceVarP(&filterIncludeSubscriptions, "include-subscription", "", nil, "only write events of clients with one of these subscriptions")
+	cmd.Flags().StringSliceVarP(&filterExcludeSubscriptions, "exclude-subscription", "", nil, "drop events of clients with any of these subscriptions")
+	cmd.Flags().StringSliceVarP(&filterIncludeEnvs, "include-env", "", nil, "only write events from these environments")
+	cmd.Flags().StringSliceVarP(&filterExcludeEnvs, "exclude-env", "", nil, "drop events from these environments")
+	cmd.Flags().StringVarP(&filterCheckRegex, "check-regex", "", "", "only write events of checks whose name matches this pattern")
+	cmd.Flags().StringVarP(&filterExcludeCheckRegex, "exclude-check-regex", "", "", "drop events of checks whose name matches this pattern")
+	cmd.Flags().StringSliceVarP(&filterStatuses, "status", "", nil, "only write events with these statuses (ok, warning, critical, unknown or a number)")
+	cmd.Flags().IntVarP(&filterMinOccurrences, "min-occurrences", "", 0, "drop events that have occurred fewer times than this")
+	cmd.Flags().DurationVarP(&filterRefresh, "refresh", "", 0, "once past --min-occurrences only write an event once per this interval (0 disables)")
+}
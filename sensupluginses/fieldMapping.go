@@ -0,0 +1,87 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// statusFields are the status document fields read back by reap, the freshness check, the availability report
+// and incident tracking. They keep their names whatever the field mapping says.
+var statusFields = []string{
+	"monitored_instance",
+	"sensu_client",
+	"check_name",
+	"check_state",
+	"incident_timestamp",
+	"check_interval",
+	"incident_id",
+	"first_seen",
+	"tags",
+}
+
+// documentFields are the other fields createStatusDocument writes, which a renamed field may not overwrite.
+var documentFields = []string{
+	"sensuEnv",
+	"instance_address",
+	"check_state_duration",
+	"check_command",
+	"check_output",
+	"truncated",
+}
+
+// fieldMapping renames status document fields, read from the fields section of the config file as the field name
+// followed by the name it is written under.
+type fieldMapping map[string]string
+
+// loadFieldMapping reads the field mapping from the fields section of the config file.
+func loadFieldMapping() (fieldMapping, error) {
+	fields := fieldMapping(viper.GetStringMapString("fields"))
+
+	renamed := make(map[string]string)
+	for from, to := range fields {
+		switch {
+		case containsString(statusFields, from):
+			return nil, fmt.Errorf("field %q is read back by other commands and can not be renamed", from)
+		case to == "":
+			return nil, fmt.Errorf("field %q is mapped to an empty name", from)
+		case containsString(statusFields, to) || containsString(documentFields, to) || fields[to] != "":
+			return nil, fmt.Errorf("field %q can not be mapped to %q, which is already a status document field", from, to)
+		}
+		if other, ok := renamed[to]; ok {
+			return nil, fmt.Errorf("fields %q and %q are both mapped to %q", other, from, to)
+		}
+		renamed[to] = from
+	}
+	return fields, nil
+}
+
+// apply renames the mapped fields of a status document.
+func (m fieldMapping) apply(doc map[string]interface{}) {
+	for from, to := range m {
+		if v, ok := doc[from]; ok {
+			delete(doc, from)
+			doc[to] = v
+		}
+	}
+}
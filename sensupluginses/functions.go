@@ -0,0 +1,484 @@
+// Library for all shared functions used by the elasticsearch sensu packages
+//
+// LICENSE:
+//   Copyright 2015 Yieldbot. <devops@yieldbot.com>
+//   Released under the MIT License; see LICENSE
+//   for details.
+
+package sensupluginses
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"github.com/yieldbot/sensuplugin/sensuhandler"
+	"github.com/yieldbot/sensuplugin/sensuutil"
+	"golang.org/x/net/context"
+)
+
+// newEsClient creates an elasticsearch client for the host and port given on the commandline.
+func newEsClient() (*elastic.Client, error) {
+	return esClientFor(esHost, esPort)
+}
+
+// esClientFor creates an elasticsearch client for the given host and port.
+func esClientFor(host string, port string) (*elastic.Client, error) {
+	return elastic.NewClient(
+		elastic.SetURL("http://" + host + ":" + port),
+	)
+}
+
+// versionType is how status documents and incidents are versioned. Every write carries a version that only grows,
+// so a write that reaches elasticsearch after a newer one is refused instead of putting the older state back.
+const versionType = "external_gte"
+
+// statusVersion returns the version a status document is written with, the time its check result was issued.
+func statusVersion(event *sensuhandler.SensuEvent) int64 {
+	return eventTime(event.Check.Issued).Unix()
+}
+
+// isSuperseded reports whether a write was refused because a newer version of the document is already indexed.
+func isSuperseded(err error) bool {
+	e, ok := err.(*elastic.Error)
+	return ok && e.Status == http.StatusConflict
+}
+
+// bulkRejected returns the failed items of a bulk request, leaving out those superseded by a newer version.
+func bulkRejected(res *elastic.BulkResponse) []*elastic.BulkResponseItem {
+	var rejected []*elastic.BulkResponseItem
+	for _, item := range res.Failed() {
+		if item.Status != http.StatusConflict {
+			rejected = append(rejected, item)
+		}
+	}
+	return rejected
+}
+
+// bulkFailure summarizes the failed items of a bulk request as a single error.
+func bulkFailure(failed []*elastic.BulkResponseItem) error {
+	reason := "unknown error"
+	if failed[0].Error != nil {
+		reason = failed[0].Error.Type + ": " + failed[0].Error.Reason
+	}
+	return fmt.Errorf("%d bulk actions failed, first error: %s", len(failed), reason)
+}
+
+// eachStatusDocument scrolls through every document in the status index and hands it to fn. Scrolling stops at the
+// first error returned by fn.
+func eachStatusDocument(ctx context.Context, client *elastic.Client, fn func(*elastic.SearchHit, statusDocument) error) error {
+	scroll := client.Scroll(esIndex).Size(500)
+	defer scroll.Clear(ctx)
+
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, hit := range res.Hits.Hits {
+			var doc statusDocument
+			if hit.Source != nil {
+				if err := json.Unmarshal(*hit.Source, &doc); err != nil {
+					return err
+				}
+			}
+			if err := fn(hit, doc); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// statusDocumentAge returns how long ago the status document was written. The second value is false when the
+// document has no usable timestamp.
+func statusDocumentAge(doc statusDocument, now time.Time) (time.Duration, bool) {
+	issued, err := time.Parse(time.RFC3339, doc.IncidentTimestamp)
+	if err != nil {
+		return 0, false
+	}
+	return now.Sub(issued), true
+}
+
+// worstState returns the more severe of two check states.
+func worstState(a string, b string) string {
+	if stateSeverity[b] > stateSeverity[a] {
+		return b
+	}
+	return a
+}
+
+// thresholdState compares a value against warning and critical thresholds. A negative threshold is disabled. When
+// below is true the value alerts when it drops under the threshold instead of rising over it.
+func thresholdState(value float64, warn float64, crit float64, below bool) string {
+	crossed := func(threshold float64) bool {
+		if threshold < 0 {
+			return false
+		}
+		if below {
+			return value < threshold
+		}
+		return value > threshold
+	}
+
+	switch {
+	case crossed(crit):
+		return "CRITICAL"
+	case crossed(warn):
+		return "WARNING"
+	default:
+		return "OK"
+	}
+}
+
+// alert raises the check to the given state and records why. OK states are ignored.
+func (c *checkOutput) alert(state string, message string) {
+	if state == "OK" {
+		return
+	}
+	c.state = worstState(c.state, state)
+	c.messages = append(c.messages, message)
+}
+
+// alertFor records the state of a single node, index or bucket. When results are sent to the sensu client socket
+// every entity becomes its own check result with the given source, named after the check and the suffix, so OK
+// states are recorded as well. Otherwise this is the same as alert.
+func (c *checkOutput) alertFor(source string, suffix string, state string, message string) {
+	if sensuSocket == "" {
+		c.alert(state, message)
+		return
+	}
+
+	entity := c.entity(source, suffix)
+	entity.state = worstState(entity.state, state)
+	entity.messages = append(entity.messages, message)
+}
+
+// entity returns the result recorded for a node, index or bucket, adding it when there is none yet.
+func (c *checkOutput) entity(source string, suffix string) *entityResult {
+	for _, e := range c.entities {
+		if e.source == source && e.name == suffix {
+			return e
+		}
+	}
+	e := &entityResult{source: source, name: suffix, state: "OK"}
+	c.entities = append(c.entities, e)
+	return e
+}
+
+// note records a message without changing the state of the check.
+func (c *checkOutput) note(message string) {
+	c.messages = append(c.messages, message)
+}
+
+// perf records a single nagios perfdata value.
+func (c *checkOutput) perf(label string, value interface{}) {
+	c.perfData = append(c.perfData, fmt.Sprintf("%s=%v", label, value))
+}
+
+// perfFor records a perfdata value of a single node, index or bucket. The check's own perfdata labels it with the
+// suffix, or the source when there is none, and the result sent for the entity carries it as well.
+func (c *checkOutput) perfFor(source string, suffix string, label string, value interface{}) {
+	name := suffix
+	if name == "" {
+		name = source
+	}
+	c.perf(perfLabel(name, label), value)
+
+	if sensuSocket != "" {
+		entity := c.entity(source, suffix)
+		entity.perfData = append(entity.perfData, fmt.Sprintf("%s=%v", perfLabel(label), value))
+	}
+}
+
+// exit prints the summary, any alert messages and the perfdata then exits with the collected state. Entity
+// results are sent to the sensu client socket first.
+func (c *checkOutput) exit(summary string) {
+	c.sendEntities()
+
+	state := c.state
+	if state == "" {
+		state = "OK"
+	}
+
+	output := summary
+	if len(c.messages) > 0 {
+		output += ": " + strings.Join(c.messages, ", ")
+	}
+	if len(c.perfData) > 0 {
+		output += " | " + strings.Join(c.perfData, " ")
+	}
+	sensuutil.Exit(state, output)
+}
+
+// checkEsClient creates an elasticsearch client for a check command. A cluster that cannot be reached is reported
+// as critical since nothing else about it can be checked.
+func checkEsClient() *elastic.Client {
+	client, err := newEsClient()
+	if err != nil {
+		syslogLog.WithFields(logrus.Fields{
+			"check":  "sensupluginses",
+			"client": host,
+			"error":  err,
+			"esHost": esHost,
+			"esPort": esPort,
+		}).Error(`Could not create an elasticsearch client`)
+		sensuutil.Exit("CRITICAL", fmt.Sprintf("Could not connect to elasticsearch at %s:%s: %v", esHost, esPort, err))
+	}
+	return client
+}
+
+// checkUnknown exits a check as unknown when the information it needs could not be read.
+func checkUnknown(message string, err error) {
+	syslogLog.WithFields(logrus.Fields{
+		"check":  "sensupluginses",
+		"client": host,
+		"error":  err,
+		"esHost": esHost,
+		"esPort": esPort,
+	}).Error(message)
+	sensuutil.Exit("UNKNOWN", fmt.Sprintf("%s: %v", message, err))
+}
+
+// perfLabelChars matches everything that can not safely appear in a perfdata label.
+var perfLabelChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// perfLabel joins the given parts into a perfdata label, replacing anything that would break the perfdata format.
+func perfLabel(parts ...string) string {
+	return perfLabelChars.ReplaceAllString(strings.Join(parts, "."), "_")
+}
+
+// statePath returns where a check keeps its state: the --state-file given, or else a file in DefaultStateDir named
+// after the check and the host and port it talks to, so checks run against several clusters do not share state.
+func statePath(path string, name string) string {
+	if path != "" {
+		return path
+	}
+	return filepath.Join(DefaultStateDir, fmt.Sprintf("%s-%s.json", name, perfLabelChars.ReplaceAllString(esHost+"_"+esPort, "_")))
+}
+
+// readState loads the state a check saved on its previous run into v. A missing or unreadable state file is
+// treated as a first run and reported as false.
+func readState(path string, v interface{}) bool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+// writeState saves v for the next run of a check. The file is replaced atomically through a temporary file of its
+// own, so neither a check killed mid-write nor two processes writing at once leave a truncated state behind.
+func writeState(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// containsString reports whether s is in list.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of a counter map in order.
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// clusterSettings returns the flattened cluster settings with transient settings taking precedence over persistent
+// ones and both over the defaults. Clusters that can not report their defaults only return what has been set.
+func clusterSettings(ctx context.Context, client *elastic.Client) (map[string]interface{}, error) {
+	params := url.Values{"flat_settings": []string{"true"}, "include_defaults": []string{"true"}}
+	res, err := client.PerformRequest(ctx, "GET", "/_cluster/settings", params, nil)
+	if err != nil {
+		params.Del("include_defaults")
+		if res, err = client.PerformRequest(ctx, "GET", "/_cluster/settings", params, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	var body struct {
+		Defaults   map[string]interface{} `json:"defaults"`
+		Persistent map[string]interface{} `json:"persistent"`
+		Transient  map[string]interface{} `json:"transient"`
+	}
+	if err := json.Unmarshal(res.Body, &body); err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]interface{})
+	for _, layer := range []map[string]interface{}{body.Defaults, body.Persistent, body.Transient} {
+		for k, v := range layer {
+			settings[k] = v
+		}
+	}
+	return settings, nil
+}
+
+// windowQuery builds a query matching the given query string or raw JSON query, limited to documents whose
+// timestamp field falls within the last since. An empty query matches everything in the window.
+func windowQuery(queryString string, queryJSON string, timestampField string, since time.Duration) elastic.Query {
+	query := elastic.NewBoolQuery()
+	switch {
+	case queryJSON != "":
+		query = query.Must(elastic.NewRawStringQuery(queryJSON))
+	case queryString != "":
+		query = query.Must(elastic.NewQueryStringQuery(queryString))
+	}
+	if since > 0 {
+		query = query.Filter(elastic.NewRangeQuery(timestampField).Gte(fmt.Sprintf("now-%ds", int64(since.Seconds()))))
+	}
+	return query
+}
+
+// queryClause returns the query clause of a JSON query given on the commandline. A full search body with a top
+// level query key is unwrapped so the same JSON can be pasted from a search request.
+func queryClause(queryJSON string) (string, error) {
+	if queryJSON == "" {
+		return "", nil
+	}
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(queryJSON), &body); err != nil {
+		return "", fmt.Errorf("invalid --query-json: %v", err)
+	}
+	if clause, ok := body["query"]; ok && len(body) == 1 {
+		return string(clause), nil
+	}
+	return queryJSON, nil
+}
+
+// sendSensuResult pushes a check result to the sensu client socket listening on address.
+func sendSensuResult(address string, name string, state string, output string, source string) error {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	result := sensuResult{
+		Name:   name,
+		Output: output,
+		Status: sensuutil.MonitoringErrorCodes[state],
+		Source: source,
+	}
+	return json.NewEncoder(conn).Encode(result)
+}
+
+// sendEntities pushes the result of every entity to the sensu client socket. A result that can not be sent leaves
+// the check itself unknown.
+func (c *checkOutput) sendEntities() {
+	if sensuSocket == "" || len(c.entities) == 0 {
+		return
+	}
+
+	sent := 0
+	for _, e := range c.entities {
+		name := sensuCheckName
+		if e.name != "" {
+			name = perfLabel(sensuCheckName, e.name)
+		}
+		output := strings.Join(e.messages, ", ")
+		if len(e.perfData) > 0 {
+			output += " | " + strings.Join(e.perfData, " ")
+		}
+		err := sendSensuResult(sensuSocket, name, e.state, output, e.source)
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":       "sensupluginses",
+				"client":      host,
+				"error":       err,
+				"sensuSocket": sensuSocket,
+				"source":      e.source,
+				"name":        name,
+			}).Error(`Could not send the result to the sensu client socket`)
+			c.alert("UNKNOWN", "could not send the result for "+name+" from "+e.source)
+			continue
+		}
+		sent++
+	}
+	c.note(fmt.Sprintf("sent %d results to the sensu client socket", sent))
+}
+
+// clusterSource returns the source of results sent to the sensu client socket for entities that are not nodes,
+// such as buckets, which is the name of the cluster. The cluster is only asked when there is a socket to send to.
+func clusterSource(ctx context.Context, client *elastic.Client) string {
+	if sensuSocket == "" {
+		return ""
+	}
+	health, err := client.ClusterHealth().Do(ctx)
+	if err != nil {
+		checkUnknown("Could not read the cluster name", err)
+	}
+	return health.ClusterName
+}
+
+// addSensuSocketFlags lets a check send a result per node, index or bucket to the sensu client socket instead of
+// folding them into its own result. The results are named after the command unless --check-name is given.
+func addSensuSocketFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&sensuSocket, "sensu-socket", "", "", "send a result per entity to the sensu client socket at this address, e.g. "+DefaultSensuSocket)
+	cmd.Flags().StringVarP(&sensuCheckName, "check-name", "", "", "the name of the results sent to the sensu client socket (default the command name)")
+	cmd.PreRun = func(c *cobra.Command, args []string) {
+		if sensuCheckName == "" {
+			sensuCheckName = c.Name()
+		}
+	}
+}
+
+// ensureIndex creates the index when it does not exist yet.
+func ensureIndex(ctx context.Context, client *elastic.Client, index string) error {
+	exists, err := client.IndexExists(index).Do(ctx)
+	if err != nil || exists {
+		return err
+	}
+	_, err = client.CreateIndex(index).Do(ctx)
+	return err
+}
@@ -24,9 +24,10 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/olivere/elastic"
 	"github.com/spf13/cobra"
 	"github.com/yieldbot/sensuplugin/sensuhandler"
+	"github.com/yieldbot/sensuplugin/sensuutil"
+	"golang.org/x/net/context"
 	//"github.com/yieldbot/sensupluginses/version"
 )
 
@@ -56,10 +57,82 @@ var handlerElasticsearchStatusCmd = &cobra.Command{
 		// set the environment this is running in (prd, dev,stg)
 		sensuEnv = sensuEnv.SetSensuEnv()
 
+		// drop the events the filter rules do not want written
+		filter, err := loadEventFilter(sensupluginses.Flags())
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":  "sensupluginses",
+				"client": host,
+				"error":  err,
+			}).Error(`Invalid event filter`)
+			sensuutil.Exit("CONFIGERROR")
+		}
+		if ok, reason := filter.allow(sensuEvent, sensuEnv); !ok {
+			syslogLog.WithFields(logrus.Fields{
+				"check":      "sensupluginses",
+				"client":     host,
+				"sensuCheck": sensuEvent.Check.Name,
+				"reason":     reason,
+			}).Info(`Event filtered`)
+			return
+		}
+
+		// skip documents that have not changed when asked to
+		mode, err := parseWriteMode(writeModeFlag)
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":  "sensupluginses",
+				"client": host,
+				"error":  err,
+			}).Error(`Invalid write mode`)
+			sensuutil.Exit("CONFIGERROR")
+		}
+
+		ids, err := loadDocIDTemplate(sensupluginses.Flags())
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":  "sensupluginses",
+				"client": host,
+				"error":  err,
+			}).Error(`Invalid document id template`)
+			sensuutil.Exit("CONFIGERROR")
+		}
+
+		redact, err := loadRedactor(sensupluginses.Flags())
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":  "sensupluginses",
+				"client": host,
+				"error":  err,
+			}).Error(`Invalid redaction rules`)
+			sensuutil.Exit("CONFIGERROR")
+		}
+
+		// pick the index the document is routed to
+		routes, err := loadRouter()
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":  "sensupluginses",
+				"client": host,
+				"error":  err,
+			}).Error(`Invalid routes`)
+			sensuutil.Exit("CONFIGERROR")
+		}
+		index := routes.route(sensuEvent, sensuEnv, esIndex)
+
+		// rename the fields the config file asks for
+		fields, err := loadFieldMapping()
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":  "sensupluginses",
+				"client": host,
+				"error":  err,
+			}).Error(`Invalid field mapping`)
+			sensuutil.Exit("CONFIGERROR")
+		}
+
 		// Create a client
-		client, err := elastic.NewClient(
-			elastic.SetURL("http://" + esHost + ":" + esPort),
-		)
+		client, err := newEsClient()
 		if err != nil {
 			syslogLog.WithFields(logrus.Fields{
 				"check":   "sensupluginses",
@@ -69,45 +142,98 @@ var handlerElasticsearchStatusCmd = &cobra.Command{
 				"esHost":  esHost,
 				"esPort":  esPort,
 			}).Error(`Could not create an elasticsearch client`)
-
+			sensuutil.Exit("RUNTIMEERROR")
 		}
 
-		// Check to see if the index exists and if not create it
-		if client.IndexExists(esIndex) == nil { // need to test to make sure this does what I want
-			_, err = client.CreateIndex(esIndex).Do()
+		// Create an Elasticsearch document. The document type will define the mapping used for the document.
+		docID, doc := createStatusDocument(sensuEvent, sensuEnv, ids, redact, fields)
+
+		// follow the incident this result belongs to, even when the status document itself is not rewritten. The
+		// incident is written after the status document so a failed status write can not orphan it.
+		var incidents []*incident
+		if trackIncidents {
+			tracker := newIncidentTracker(client, !mode.onChange)
+			incidents, err = tracker.observe(context.Background(), index, docID, doc, eventTime(sensuEvent.Check.Issued), filter.silentAfter(sensuEvent.Check.Interval))
 			if err != nil {
 				syslogLog.WithFields(logrus.Fields{
-					"check":   "sensupluginses",
-					"client":  host,
-					//"version": version.AppVersion(),
-					"error":   err,
-					"esIndex": esIndex,
-				}).Error(`Could not create an elasticsearch index`)
+					"check":         "sensupluginses",
+					"client":        host,
+					"error":         err,
+					"incidentIndex": incidentIndex,
+					"sensuCheck":    sensuEvent.Check.Name,
+				}).Error(`Could not look up the incident`)
+			}
+		}
+		defer func() {
+			for _, inc := range incidents {
+				if err := writeIncident(context.Background(), client, inc); err != nil {
+					syslogLog.WithFields(logrus.Fields{
+						"check":         "sensupluginses",
+						"client":        host,
+						"error":         err,
+						"incidentIndex": incidentIndex,
+						"sensuCheck":    sensuEvent.Check.Name,
+					}).Error(`Could not record the incident`)
+				}
+			}
+		}()
 
+		cacheKey := pendingKey(index, docID)
+		write := true
+		if mode.onChange {
+			err := updateWriteCache(writeCachePath, time.Now(), func(writes *writeCache) {
+				write = writes.shouldWrite(mode, cacheKey, doc, time.Now())
+			})
+			if err != nil {
+				syslogLog.WithFields(logrus.Fields{
+					"check":      "sensupluginses",
+					"client":     host,
+					"error":      err,
+					"writeCache": writeCachePath,
+				}).Error(`Could not update the write cache`)
 			}
 		}
+		if !write {
+			syslogLog.WithFields(logrus.Fields{
+				"check":      "sensupluginses",
+				"client":     host,
+				"sensuCheck": sensuEvent.Check.Name,
+				"esIndex":    index,
+			}).Info(`Document unchanged, not posted`)
+			return
+		}
 
-		// Create an Elasticsearch document. The document type will define the mapping used for the document.
-		doc := make(map[string]interface{})
-		var docID string
-		docID = sensuhandler.EventName(sensuEvent.Client.Name, sensuEvent.Check.Name)
-		doc["monitored_instance"] = sensuEvent.AcquireMonitoredInstance()
-		doc["sensu_client"] = sensuEvent.Client.Name
-		doc["incident_timestamp"] = time.Unix(sensuEvent.Check.Issued, 0).Format(time.RFC3339)
-		doc["check_name"] = sensuhandler.CreateCheckName(sensuEvent.Check.Name)
-		doc["check_state"] = sensuhandler.DefineStatus(sensuEvent.Check.Status)
-		doc["sensuEnv"] = sensuhandler.DefineSensuEnv(sensuEnv.Sensu.Environment)
-		doc["tags"] = sensuEvent.Check.Tags
-		doc["instance_address"] = sensuEvent.Client.Address
-		doc["check_state_duration"] = sensuhandler.DefineCheckStateDuration()
-
-		// Add a document to the Elasticsearch index
+		// Check to see if the index exists and if not create it
+		if err := ensureIndex(context.Background(), client, index); err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":   "sensupluginses",
+				"client":  host,
+				//"version": version.AppVersion(),
+				"error":   err,
+				"esIndex": index,
+			}).Error(`Could not create an elasticsearch index`)
+
+		}
+
+		// Add a document to the Elasticsearch index, unless a result issued later has already been written
 		_, err = client.Index().
-			Index(esIndex).
+			Index(index).
 			Type(esType).
 			Id(docID).
+			Version(statusVersion(sensuEvent)).
+			VersionType(versionType).
 			BodyJson(doc).
-			Do()
+			Do(context.Background())
+		if isSuperseded(err) {
+			syslogLog.WithFields(logrus.Fields{
+				"check":      "sensupluginses",
+				"client":     host,
+				"sensuCheck": sensuEvent.Check.Name,
+				"esIndex":    index,
+			}).Info(`A newer document is already indexed, not posted`)
+			incidents = nil
+			return
+		}
 		if err != nil {
 			syslogLog.WithFields(logrus.Fields{
 				"check":   "sensupluginses",
@@ -116,9 +242,15 @@ var handlerElasticsearchStatusCmd = &cobra.Command{
 				"error":   err,
 				"esHost":  esHost,
 				"esPort":  esPort,
-				"esIndex": esIndex,
+				"esIndex": index,
 			}).Error(`Could not post a document to elasticsearch`)
-
+			if mode.onChange {
+				updateWriteCache(writeCachePath, time.Now(), func(writes *writeCache) {
+					writes.forget(cacheKey)
+				})
+			}
+			incidents = nil
+			return
 		}
 
 		// Log a successful document push to stdout. I don't add the id here as some id's are fixed but
@@ -129,11 +261,38 @@ var handlerElasticsearchStatusCmd = &cobra.Command{
 			//"version": version.AppVersion(),
 			"esHost":  esHost,
 			"esPort":  esPort,
-			"esIndex": esIndex,
+			"esIndex": index,
 		}).Info(`Document posted to elasticsearch`)
 	},
 }
 
+// createStatusDocument builds the status document and its id for a check result. Everything that writes status
+// documents goes through here so the handler and the serve daemon always produce identical documents.
+func createStatusDocument(sensuEvent *sensuhandler.SensuEvent, env *sensuhandler.EnvDetails, ids *docIDTemplate, redact *redactor, fields fieldMapping) (string, map[string]interface{}) {
+	doc := make(map[string]interface{})
+	docID := ids.eventID(sensuEvent, env)
+	doc["monitored_instance"] = sensuEvent.AcquireMonitoredInstance()
+	doc["sensu_client"] = sensuEvent.Client.Name
+	doc["incident_timestamp"] = time.Unix(sensuEvent.Check.Issued, 0).Format(time.RFC3339)
+	doc["check_name"] = sensuhandler.CreateCheckName(sensuEvent.Check.Name)
+	doc["check_state"] = sensuhandler.DefineStatus(sensuEvent.Check.Status)
+	doc["sensuEnv"] = sensuhandler.DefineSensuEnv(env.Sensu.Environment)
+	doc["tags"] = sensuEvent.Check.Tags
+	doc["instance_address"] = sensuEvent.Client.Address
+	doc["check_state_duration"] = sensuhandler.DefineCheckStateDuration()
+	doc["check_interval"] = sensuEvent.Check.Interval
+
+	command, commandCut := redact.clean(sensuEvent.Check.Command)
+	output, outputCut := redact.clean(sensuEvent.Check.Output)
+	doc["check_command"] = command
+	doc["check_output"] = output
+	if commandCut || outputCut {
+		doc["truncated"] = true
+	}
+	fields.apply(doc)
+	return docID, doc
+}
+
 func init() {
 	RootCmd.AddCommand(handlerElasticsearchStatusCmd)
 
@@ -141,5 +300,10 @@ func init() {
 	handlerElasticsearchStatusCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
 	handlerElasticsearchStatusCmd.Flags().StringVarP(&esIndex, "index", "", StatusEsIndex, "the es index to populate")
 	handlerElasticsearchStatusCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	addEventFilterFlags(handlerElasticsearchStatusCmd)
+	addWriteModeFlags(handlerElasticsearchStatusCmd)
+	addDocIDFlags(handlerElasticsearchStatusCmd)
+	addRedactFlags(handlerElasticsearchStatusCmd)
+	addIncidentFlags(handlerElasticsearchStatusCmd)
 
 }
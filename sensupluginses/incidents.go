@@ -0,0 +1,341 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+// incident tracking configuration
+var trackIncidents bool
+var incidentIndex string
+
+// incidentType is the document type of incident documents.
+const incidentType = "incident"
+
+// incident is a single non-OK episode of a check, from the first non-OK result to the return to OK.
+type incident struct {
+	ID                string               `json:"incident_id"`
+	StatusIndex       string               `json:"status_index"`
+	StatusID          string               `json:"status_id"`
+	MonitoredInstance string               `json:"monitored_instance"`
+	SensuClient       string               `json:"sensu_client"`
+	CheckName         string               `json:"check_name"`
+	OpenedAt          string               `json:"opened_at"`
+	ClosedAt          string               `json:"closed_at,omitempty"`
+	WorstState        string               `json:"worst_state"`
+	Duration          int64                `json:"duration"`
+	EventCount        int                  `json:"event_count"`
+	LastSeen          string               `json:"last_seen"`
+	CheckInterval     int                  `json:"check_interval"`
+	Tags              []string             `json:"tags"`
+	Transitions       []incidentTransition `json:"transitions"`
+	Gaps              []incidentGap        `json:"gaps,omitempty"`
+	Silence           bool                 `json:"silence,omitempty"`
+}
+
+// incidentTransition records when an incident moved to a new state, starting with the state it opened in.
+type incidentTransition struct {
+	State string `json:"state"`
+	At    string `json:"at"`
+}
+
+// incidentGap records a stretch in which the check was not heard from while the incident was open, from the last
+// event before the silence to the first one after it.
+type incidentGap struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// document returns the incident as it is indexed.
+func (inc *incident) document() map[string]interface{} {
+	doc := map[string]interface{}{
+		"incident_id":        inc.ID,
+		"status_index":       inc.StatusIndex,
+		"status_id":          inc.StatusID,
+		"monitored_instance": inc.MonitoredInstance,
+		"sensu_client":       inc.SensuClient,
+		"check_name":         inc.CheckName,
+		"opened_at":          inc.OpenedAt,
+		"worst_state":        inc.WorstState,
+		"duration":           inc.Duration,
+		"event_count":        inc.EventCount,
+		"last_seen":          inc.LastSeen,
+		"check_interval":     inc.CheckInterval,
+		"tags":               inc.Tags,
+		"transitions":        inc.Transitions,
+	}
+	if inc.ClosedAt != "" {
+		doc["closed_at"] = inc.ClosedAt
+	}
+	if len(inc.Gaps) > 0 {
+		doc["gaps"] = inc.Gaps
+	}
+	if inc.Silence {
+		doc["silence"] = true
+	}
+	return doc
+}
+
+// describe copies the check details of the status document being written onto the incident.
+func (inc *incident) describe(doc map[string]interface{}) {
+	inc.MonitoredInstance, _ = doc["monitored_instance"].(string)
+	inc.SensuClient, _ = doc["sensu_client"].(string)
+	inc.CheckName, _ = doc["check_name"].(string)
+	inc.CheckInterval, _ = doc["check_interval"].(int)
+	inc.Tags, _ = doc["tags"].([]string)
+}
+
+// incidentTracker follows the open incident of every status document and when its check was first and last heard
+// from. Checks are remembered between events; one not seen before is looked up through its status document so the
+// handler, which starts fresh for every event, and a restarted serve daemon pick up where they left off.
+type incidentTracker struct {
+	client    *elastic.Client
+	heartbeat bool
+	mu        sync.Mutex
+	checks    map[string]*trackedCheck
+}
+
+// trackedCheck is what the tracker knows about one status document. latest is the issue time of the newest result
+// written, lastSeen that of the newest result known to have arrived, which is only taken from the status document
+// when every result is written.
+type trackedCheck struct {
+	open      *incident
+	firstSeen time.Time
+	lastSeen  time.Time
+	latest    time.Time
+}
+
+// newIncidentTracker creates a tracker that looks incidents up through client. heartbeat says whether the
+// incident_timestamp of a stored status document is the last time its check was heard from, which only holds when
+// every result is written; without it silences are only noticed between events the tracker saw itself.
+func newIncidentTracker(client *elastic.Client, heartbeat bool) *incidentTracker {
+	return &incidentTracker{client: client, heartbeat: heartbeat, checks: make(map[string]*trackedCheck)}
+}
+
+// setClient switches the client incidents are looked up through.
+func (t *incidentTracker) setClient(client *elastic.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.client = client
+}
+
+// observe records the state of a status document that is about to be written, stamps it with the id of the open
+// incident and with when the check was first heard from. It returns the incident documents to write: a silence
+// when an OK check went unheard for longer than silentAfter, and the incident the result belongs to unless the
+// check is OK and was OK before. A silentAfter of 0 turns silence detection off. A result issued before the newest
+// one is out of order; its status document will be refused and it changes nothing.
+func (t *incidentTracker) observe(ctx context.Context, statusIndex string, statusID string, doc map[string]interface{}, at time.Time, silentAfter time.Duration) ([]*incident, error) {
+	key := pendingKey(statusIndex, statusID)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, known := t.checks[key]
+	if !known {
+		var err error
+		if c, err = t.load(ctx, statusIndex, statusID); err != nil {
+			return nil, err
+		}
+		t.checks[key] = c
+	}
+
+	if c.firstSeen.IsZero() || at.Before(c.firstSeen) {
+		c.firstSeen = at
+	}
+	doc["first_seen"] = c.firstSeen.Format(time.RFC3339)
+	if at.Before(c.latest) {
+		return nil, nil
+	}
+	c.latest = at
+
+	var incidents []*incident
+	if silentAfter > 0 && !c.lastSeen.IsZero() && at.Sub(c.lastSeen) > silentAfter {
+		if c.open != nil {
+			c.open.Gaps = append(c.open.Gaps, incidentGap{From: c.lastSeen.Format(time.RFC3339), To: at.Format(time.RFC3339)})
+		} else {
+			incidents = append(incidents, silence(key, statusIndex, statusID, doc, c.lastSeen, at))
+		}
+	}
+	if at.After(c.lastSeen) {
+		c.lastSeen = at
+	}
+
+	inc := c.open
+	state, _ := doc["check_state"].(string)
+	if state == "OK" {
+		c.open = nil
+		if inc == nil {
+			return incidents, nil
+		}
+		inc.ClosedAt = at.Format(time.RFC3339)
+		inc.LastSeen = inc.ClosedAt
+		inc.Duration = incidentDuration(inc, at)
+		inc.EventCount++
+		return append(incidents, inc), nil
+	}
+
+	if inc == nil {
+		inc = &incident{
+			ID:          hashID(fmt.Sprintf("%s/%d", key, at.UnixNano())),
+			StatusIndex: statusIndex,
+			StatusID:    statusID,
+			OpenedAt:    at.Format(time.RFC3339),
+			WorstState:  state,
+		}
+	}
+	inc.describe(doc)
+	inc.WorstState = worstState(inc.WorstState, state)
+	inc.Duration = incidentDuration(inc, at)
+	inc.EventCount++
+	inc.LastSeen = at.Format(time.RFC3339)
+	if n := len(inc.Transitions); n == 0 || inc.Transitions[n-1].State != state {
+		inc.Transitions = append(inc.Transitions, incidentTransition{State: state, At: inc.LastSeen})
+	}
+
+	c.open = inc
+	doc["incident_id"] = inc.ID
+	copied := *inc
+	copied.Transitions = append([]incidentTransition(nil), inc.Transitions...)
+	copied.Gaps = append([]incidentGap(nil), inc.Gaps...)
+	return append(incidents, &copied), nil
+}
+
+// silence records a stretch in which an OK check was not heard from, from its last event before the silence to the
+// first one after it. Silences are kept in the incident index so the availability report can count them as unknown,
+// but they are not incidents of the check and no status document points at them.
+func silence(key string, statusIndex string, statusID string, doc map[string]interface{}, from time.Time, to time.Time) *incident {
+	inc := &incident{
+		ID:          hashID(fmt.Sprintf("%s/silence/%d", key, to.UnixNano())),
+		StatusIndex: statusIndex,
+		StatusID:    statusID,
+		OpenedAt:    from.Format(time.RFC3339),
+		ClosedAt:    to.Format(time.RFC3339),
+		LastSeen:    from.Format(time.RFC3339),
+		WorstState:  "UNKNOWN",
+		Duration:    int64(to.Sub(from).Seconds()),
+		EventCount:  1,
+		Transitions: []incidentTransition{{State: "UNKNOWN", At: from.Format(time.RFC3339)}},
+		Silence:     true,
+	}
+	inc.describe(doc)
+	return inc
+}
+
+// writeIncident indexes an incident, versioned on its event count so an older update never replaces a newer one.
+func writeIncident(ctx context.Context, client *elastic.Client, inc *incident) error {
+	_, err := client.Index().
+		Index(incidentIndex).
+		Type(incidentType).
+		Id(inc.ID).
+		Version(int64(inc.EventCount)).
+		VersionType(versionType).
+		BodyJson(inc.document()).
+		Do(ctx)
+	if isSuperseded(err) {
+		return nil
+	}
+	return err
+}
+
+// load finds what is known about a check from its status document: when it was first heard from, when it was last
+// heard from if the document keeps that, and its open incident through the incident_id it was last written with. A
+// missing status document or incident means the check is new or has no open incident.
+func (t *incidentTracker) load(ctx context.Context, statusIndex string, statusID string) (*trackedCheck, error) {
+	c := new(trackedCheck)
+	res, err := t.client.Get().Index(statusIndex).Id(statusID).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var status statusDocument
+	if res.Source != nil {
+		if err := json.Unmarshal(*res.Source, &status); err != nil {
+			return nil, err
+		}
+	}
+	// documents written before first_seen was kept vouch for their check from their last write on
+	seen, _ := time.Parse(time.RFC3339, status.IncidentTimestamp)
+	if first, err := time.Parse(time.RFC3339, status.FirstSeen); err == nil {
+		c.firstSeen = first
+	} else {
+		c.firstSeen = seen
+	}
+	c.latest = seen
+	if t.heartbeat {
+		c.lastSeen = seen
+	}
+	if status.IncidentID == "" {
+		return c, nil
+	}
+
+	res, err = t.client.Get().Index(incidentIndex).Type(incidentType).Id(status.IncidentID).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	inc := new(incident)
+	if res.Source != nil {
+		if err := json.Unmarshal(*res.Source, inc); err != nil {
+			return nil, err
+		}
+	}
+	if inc.ClosedAt == "" {
+		c.open = inc
+	}
+	return c, nil
+}
+
+// incidentDuration returns how many seconds the incident has been open at the given time.
+func incidentDuration(inc *incident, at time.Time) int64 {
+	opened, err := time.Parse(time.RFC3339, inc.OpenedAt)
+	if err != nil || at.Before(opened) {
+		return 0
+	}
+	return int64(at.Sub(opened).Seconds())
+}
+
+// eventTime returns when a check result was issued, or now if sensu did not say.
+func eventTime(issued int64) time.Time {
+	if issued <= 0 {
+		return time.Now()
+	}
+	return time.Unix(issued, 0)
+}
+
+// addIncidentFlags adds the flags that turn on incident tracking.
+func addIncidentFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&trackIncidents, "track-incidents", "", false, "record every non-OK episode in the incident index and stamp its id on the status document")
+	cmd.Flags().StringVarP(&incidentIndex, "incident-index", "", IncidentsEsIndex, "the es index incidents are kept in")
+}
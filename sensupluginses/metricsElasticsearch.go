@@ -0,0 +1,323 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"github.com/yieldbot/sensuplugin/sensuutil"
+	"golang.org/x/net/context"
+)
+
+// metrics configuration
+var metricsScheme string
+var metricsFormat string
+var metricsStats []string
+var metricsIndices []string
+var metricsStateFile string
+
+// healthCodes turns the cluster health into a number that can be graphed.
+var healthCodes = map[string]float64{
+	"green":  0,
+	"yellow": 1,
+	"red":    2,
+}
+
+// rateCounters are the counters turned into per second rates between runs, keyed on the last two parts of their
+// name, with the name of the rate that replaces the last part.
+var rateCounters = map[string]string{
+	"indexing.index_total": "index_per_second",
+	"search.query_total":   "query_per_second",
+	"search.fetch_total":   "fetch_per_second",
+}
+
+// metricTotals are the rate counters of a metric set saved between runs.
+type metricTotals struct {
+	Timestamp int64              `json:"timestamp"`
+	Totals    map[string]float64 `json:"totals"`
+}
+
+// metricPoint is a single named value of a metric set.
+type metricPoint struct {
+	name  []string
+	value float64
+}
+
+// metricSet is every value collected for one cluster, node or index.
+type metricSet struct {
+	kind   string
+	tags   [][2]string
+	values []metricPoint
+}
+
+// metricsElasticsearchCmd prints cluster, node and index stats for a sensu metric check
+var metricsElasticsearchCmd = &cobra.Command{
+	Use:   "metricsElasticsearch --host <host> --port <port> --scheme <scheme> --format graphite|influxdb",
+	Short: "Print elasticsearch cluster, node and index stats as graphite or influxdb metrics.",
+	Long: `This will collect the cluster stats, the stats of every node and the stats of every index matching
+  --indices and print every numeric value in graphite plaintext or influxdb line protocol, prefixed
+  with --scheme. Counters such as indexing and search totals are printed as they are, along with the
+  indexing, query and fetch rates per second since the totals saved in --state-file on the previous
+  run, so the first run prints no rates. Use --stats to limit which of cluster, node and index are
+  collected.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		if metricsFormat != "graphite" && metricsFormat != "influxdb" {
+			sensuutil.Exit("CONFIGERROR", "--format must be graphite or influxdb")
+		}
+
+		client := checkEsClient()
+		ctx := context.Background()
+
+		sets, err := collectMetrics(ctx, client)
+		if err != nil {
+			checkUnknown("Could not collect the elasticsearch stats", err)
+		}
+
+		now := time.Now()
+		metricsStateFile = statePath(metricsStateFile, "metrics")
+		previous := make(map[string]metricTotals)
+		readState(metricsStateFile, &previous)
+		current := make(map[string]metricTotals)
+		for i := range sets {
+			sets[i].addRates(previous, current, now)
+		}
+		if err := writeState(metricsStateFile, current); err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":     "sensupluginses",
+				"client":    host,
+				"error":     err,
+				"stateFile": metricsStateFile,
+			}).Error(`Could not save the metric totals`)
+		}
+
+		for _, set := range sets {
+			if metricsFormat == "influxdb" {
+				if line, ok := set.influxLine(now); ok {
+					fmt.Println(line)
+				}
+				continue
+			}
+			for _, line := range set.graphiteLines(now) {
+				fmt.Println(line)
+			}
+		}
+	},
+}
+
+// collectMetrics gathers the requested stats from the cluster.
+func collectMetrics(ctx context.Context, client *elastic.Client) ([]metricSet, error) {
+	var sets []metricSet
+
+	cluster, err := client.ClusterStats().Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	clusterTag := [2]string{"cluster", cluster.ClusterName}
+
+	if containsString(metricsStats, "cluster") {
+		set := metricSet{kind: "cluster", tags: [][2]string{clusterTag}}
+		set.values = append(set.values, metricPoint{name: []string{"status"}, value: healthCodes[cluster.Status]})
+		set.add([]string{"indices"}, cluster.Indices)
+		if cluster.Nodes != nil {
+			set.add([]string{"nodes", "count"}, cluster.Nodes.Count)
+		}
+		sets = append(sets, set)
+	}
+
+	if containsString(metricsStats, "node") {
+		nodes, err := client.NodesStats().Metric("indices", "jvm", "thread_pool", "breaker", "fs").Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range sortedNodeIDs(nodes) {
+			node := nodes.Nodes[id]
+			set := metricSet{kind: "node", tags: [][2]string{clusterTag, {"node", node.Name}}}
+			set.add([]string{"indices"}, node.Indices)
+			set.add([]string{"jvm"}, node.JVM)
+			set.add([]string{"thread_pool"}, node.ThreadPool)
+			set.add([]string{"breaker"}, node.Breaker)
+			if node.FS != nil {
+				set.add([]string{"fs"}, node.FS.Total)
+			}
+			sets = append(sets, set)
+		}
+	}
+
+	if containsString(metricsStats, "index") {
+		indices, err := client.IndexStats(metricsIndices...).Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for name := range indices.Indices {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			set := metricSet{kind: "index", tags: [][2]string{clusterTag, {"index", name}}}
+			set.add(nil, indices.Indices[name].Total)
+			sets = append(sets, set)
+		}
+	}
+
+	return sets, nil
+}
+
+// add flattens every numeric value found in stats into the set under the given name.
+func (m *metricSet) add(name []string, stats interface{}) {
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return
+	}
+	var tree interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return
+	}
+	m.flatten(name, tree)
+}
+
+// flatten walks a decoded JSON tree in key order collecting its numbers.
+func (m *metricSet) flatten(name []string, node interface{}) {
+	switch v := node.(type) {
+	case float64:
+		m.values = append(m.values, metricPoint{name: append([]string(nil), name...), value: v})
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			m.flatten(append(name, k), v[k])
+		}
+	}
+}
+
+// key identifies the set between runs by its kind and tags.
+func (m metricSet) key() string {
+	parts := []string{m.kind}
+	for _, tag := range m.tags {
+		parts = append(parts, tag[1])
+	}
+	return strings.Join(parts, "/")
+}
+
+// addRates adds a per second rate for every rate counter in the set from its total on the previous run, and records
+// the totals of this run in current. A counter seen for the first time, or that went backwards because the node
+// restarted, gets no rate.
+func (m *metricSet) addRates(previous map[string]metricTotals, current map[string]metricTotals, now time.Time) {
+	totals := metricTotals{Timestamp: now.UnixNano() / int64(time.Millisecond), Totals: make(map[string]float64)}
+	last, known := previous[m.key()]
+	elapsed := time.Duration(totals.Timestamp-last.Timestamp) * time.Millisecond
+
+	var rates []metricPoint
+	for _, v := range m.values {
+		n := len(v.name)
+		if n < 2 {
+			continue
+		}
+		rate, ok := rateCounters[v.name[n-2]+"."+v.name[n-1]]
+		if !ok {
+			continue
+		}
+		path := strings.Join(v.name, ".")
+		totals.Totals[path] = v.value
+
+		before, ok := last.Totals[path]
+		if !known || !ok || elapsed <= 0 || v.value < before {
+			continue
+		}
+		name := append(append([]string(nil), v.name[:n-1]...), rate)
+		rates = append(rates, metricPoint{name: name, value: (v.value - before) / elapsed.Seconds()})
+	}
+	m.values = append(m.values, rates...)
+	current[m.key()] = totals
+}
+
+// graphiteLines formats the set as graphite plaintext, one line per value.
+func (m metricSet) graphiteLines(now time.Time) []string {
+	prefix := []string{metricsScheme, m.tags[0][1], m.kind}
+	for _, tag := range m.tags[1:] {
+		prefix = append(prefix, tag[1])
+	}
+
+	lines := make([]string, 0, len(m.values))
+	for _, v := range m.values {
+		path := make([]string, 0, len(prefix)+len(v.name))
+		for _, p := range append(prefix, v.name...) {
+			path = append(path, perfLabel(p))
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %d", strings.Join(path, "."), formatMetric(v.value), now.Unix()))
+	}
+	return lines
+}
+
+// influxLine formats the set as a single influxdb line protocol point. A set without values has no point, as the
+// line protocol requires at least one field.
+func (m metricSet) influxLine(now time.Time) (string, bool) {
+	if len(m.values) == 0 {
+		return "", false
+	}
+
+	measurement := influxEscape(metricsScheme + "_" + m.kind)
+	for _, tag := range m.tags {
+		measurement += "," + influxEscape(tag[0]) + "=" + influxEscape(tag[1])
+	}
+
+	fields := make([]string, 0, len(m.values))
+	for _, v := range m.values {
+		fields = append(fields, influxEscape(strings.Join(v.name, "_"))+"="+formatMetric(v.value))
+	}
+	return fmt.Sprintf("%s %s %d", measurement, strings.Join(fields, ","), now.UnixNano()), true
+}
+
+// influxEscape escapes the characters influxdb treats specially in measurements, tags and field keys.
+func influxEscape(s string) string {
+	return strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`).Replace(s)
+}
+
+// formatMetric prints a value without a trailing fraction when it is whole.
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func init() {
+	RootCmd.AddCommand(metricsElasticsearchCmd)
+
+	// set commandline flags
+	metricsElasticsearchCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	metricsElasticsearchCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	metricsElasticsearchCmd.Flags().StringVarP(&metricsScheme, "scheme", "", "elasticsearch", "the prefix of every metric")
+	metricsElasticsearchCmd.Flags().StringVarP(&metricsFormat, "format", "", "graphite", "the output format, graphite or influxdb")
+	metricsElasticsearchCmd.Flags().StringSliceVarP(&metricsStats, "stats", "", []string{"cluster", "node", "index"}, "the stats to collect")
+	metricsElasticsearchCmd.Flags().StringSliceVarP(&metricsIndices, "indices", "", nil, "limit the index stats to these indices (default all)")
+	metricsElasticsearchCmd.Flags().StringVarP(&metricsStateFile, "state-file", "", "", "where the counter totals are kept between runs (default metrics-<host>_<port>.json in "+DefaultStateDir+")")
+}
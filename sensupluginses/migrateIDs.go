@@ -0,0 +1,242 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"github.com/yieldbot/sensuplugin/sensuhandler"
+	"github.com/yieldbot/sensuplugin/sensuutil"
+	"golang.org/x/net/context"
+)
+
+// id migration configuration
+var migrateEnv string
+var migrateDatacenter string
+var migrateDryRun bool
+
+// idMigration moves a status document from its old id to the one the id template gives it.
+type idMigration struct {
+	index  string
+	from   string
+	to     string
+	typ    string
+	source map[string]interface{}
+}
+
+// migrateIDsCmd rewrites existing status documents under the configured id template
+var migrateIDsCmd = &cobra.Command{
+	Use:   "migrateIDs --index <index> --id-template <template> [--env <env>] [--datacenter <dc>] [--dry-run]",
+	Short: "Move existing status documents to the ids given by the id template.",
+	Long: `Changing the id template, or moving from the legacy client based ids to the source aware default,
+  leaves the existing documents under their old ids where they would never be updated again. This
+  will give every status document the id the template builds for it. The check name is recovered
+  from the end of the old id, so documents whose old id does not end with the check name, or was
+  hashed, are reported and left alone. Status documents do not record the raw environment or
+  datacenter, so templates using them need --env and --datacenter. When a document already exists
+  under the new id it is newer than the one being moved, which is then only deleted.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		ids, err := loadDocIDTemplate(sensupluginses.Flags())
+		if err != nil {
+			sensuutil.Exit("CONFIGERROR", err.Error())
+		}
+
+		client, err := newEsClient()
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":  "sensupluginses",
+				"client": host,
+				"error":  err,
+				"esHost": esHost,
+				"esPort": esPort,
+			}).Error(`Could not create an elasticsearch client`)
+			sensuutil.Exit("RUNTIMEERROR")
+		}
+
+		ctx := context.Background()
+		moves, skipped, total, err := planIDMigrations(ctx, client, ids)
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":   "sensupluginses",
+				"client":  host,
+				"error":   err,
+				"esIndex": esIndex,
+			}).Error(`Could not read the status documents`)
+			sensuutil.Exit("RUNTIMEERROR")
+		}
+
+		for _, id := range skipped {
+			fmt.Printf("%s\tskipped, the check name can not be recovered from the id\n", id)
+		}
+		for _, m := range moves {
+			fmt.Printf("%s/%s\t-> %s\n", m.index, m.from, m.to)
+		}
+
+		if migrateDryRun {
+			fmt.Printf("%d of %d status documents would be moved in %s\n", len(moves), total, esIndex)
+			return
+		}
+
+		moved, err := applyIDMigrations(ctx, client, moves)
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":   "sensupluginses",
+				"client":  host,
+				"error":   err,
+				"esIndex": esIndex,
+			}).Error(`Could not move the status documents`)
+		}
+
+		syslogLog.WithFields(logrus.Fields{
+			"check":      "sensupluginses",
+			"client":     host,
+			"esIndex":    esIndex,
+			"idTemplate": ids.text,
+			"moved":      moved,
+		}).Info(`Status document ids migrated`)
+		fmt.Printf("%d of %d status documents moved in %s\n", moved, total, esIndex)
+
+		if err != nil {
+			sensuutil.Exit("RUNTIMEERROR")
+		}
+	},
+}
+
+// planIDMigrations scrolls through the status index and returns the documents whose id differs from what the
+// template builds, the ids of the documents that can not be migrated and the number of documents examined.
+func planIDMigrations(ctx context.Context, client *elastic.Client, ids *docIDTemplate) ([]idMigration, []string, int, error) {
+	var moves []idMigration
+	var skipped []string
+	total := 0
+
+	err := eachStatusDocument(ctx, client, func(hit *elastic.SearchHit, doc statusDocument) error {
+		total++
+
+		// check names are stored with dashes replaced by dots, which keeps their length, so the raw name is the
+		// end of the old id as long as the old template ended with the check
+		if doc.CheckName == "" || len(hit.Id) < len(doc.CheckName) {
+			skipped = append(skipped, hit.Id)
+			return nil
+		}
+		check := hit.Id[len(hit.Id)-len(doc.CheckName):]
+		if sensuhandler.CreateCheckName(check) != doc.CheckName {
+			skipped = append(skipped, hit.Id)
+			return nil
+		}
+
+		fields := docIDFields{
+			Client:     doc.SensuClient,
+			Instance:   doc.MonitoredInstance,
+			Check:      check,
+			Env:        migrateEnv,
+			Datacenter: migrateDatacenter,
+		}
+		if fields.Instance == "" {
+			fields.Instance = fields.Client
+		}
+		if fields.Instance != fields.Client {
+			fields.Source = fields.Instance
+		}
+
+		to, err := ids.render(fields)
+		if err != nil {
+			return fmt.Errorf("%s: %v", hit.Id, err)
+		}
+		if to == hit.Id {
+			return nil
+		}
+
+		var source map[string]interface{}
+		if err := json.Unmarshal(*hit.Source, &source); err != nil {
+			return err
+		}
+		moves = append(moves, idMigration{index: hit.Index, from: hit.Id, to: to, typ: hit.Type, source: source})
+		return nil
+	})
+	return moves, skipped, total, err
+}
+
+// applyIDMigrations creates each document under its new id and deletes the old one once the new one exists. A
+// document already present under the new id is kept as it was written after the one being moved.
+func applyIDMigrations(ctx context.Context, client *elastic.Client, moves []idMigration) (int, error) {
+	moved := 0
+
+	for start := 0; start < len(moves); start += 500 {
+		end := start + 500
+		if end > len(moves) {
+			end = len(moves)
+		}
+		batch := moves[start:end]
+
+		create := client.Bulk()
+		for _, m := range batch {
+			create.Add(elastic.NewBulkIndexRequest().OpType("create").Index(m.index).Type(m.typ).Id(m.to).Doc(m.source))
+		}
+		res, err := create.Do(ctx)
+		if err != nil {
+			return moved, err
+		}
+
+		var failed []*elastic.BulkResponseItem
+		remove := client.Bulk()
+		for i, item := range res.Items {
+			for _, result := range item {
+				if (result.Status < 200 || result.Status > 299) && result.Status != 409 {
+					failed = append(failed, result)
+					continue
+				}
+				remove.Add(elastic.NewBulkDeleteRequest().Index(batch[i].index).Type(batch[i].typ).Id(batch[i].from))
+			}
+		}
+
+		if remove.NumberOfActions() > 0 {
+			res, err := remove.Do(ctx)
+			if err != nil {
+				return moved, err
+			}
+			moved += len(res.Deleted())
+			failed = append(failed, res.Failed()...)
+		}
+		if len(failed) > 0 {
+			return moved, bulkFailure(failed)
+		}
+	}
+	return moved, nil
+}
+
+func init() {
+	RootCmd.AddCommand(migrateIDsCmd)
+
+	// set commandline flags
+	migrateIDsCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	migrateIDsCmd.Flags().StringVarP(&esIndex, "index", "", StatusEsIndex, "the es index to migrate")
+	migrateIDsCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	migrateIDsCmd.Flags().StringVarP(&migrateEnv, "env", "", "", "the environment used by templates containing {{.Env}}")
+	migrateIDsCmd.Flags().StringVarP(&migrateDatacenter, "datacenter", "", "", "the datacenter used by templates containing {{.Datacenter}}")
+	migrateIDsCmd.Flags().BoolVarP(&migrateDryRun, "dry-run", "", false, "report what would be moved without moving anything")
+	addDocIDFlags(migrateIDsCmd)
+}
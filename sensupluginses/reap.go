@@ -0,0 +1,251 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"github.com/yieldbot/sensuplugin/sensuutil"
+	"golang.org/x/net/context"
+)
+
+// reaper configuration
+var reapOlderThan time.Duration
+var reapIntervalMultiplier int
+var reapDryRun bool
+var reapArchiveIndex string
+
+// staleDocument is a status document that has been selected for removal.
+type staleDocument struct {
+	index  string
+	id     string
+	typ    string
+	age    time.Duration
+	doc    statusDocument
+	source map[string]interface{}
+}
+
+// reapCmd removes status documents left behind by decommissioned clients
+var reapCmd = &cobra.Command{
+	Use:   "reap --index <index> --older-than <duration> --interval-multiplier <n> [--dry-run]",
+	Short: "Remove status documents that have not been updated in a given amount of time.",
+	Long: `Status documents are keyed on the client and check name so a terminated instance will leave
+  its last state in the status index forever. This will find every document whose incident_timestamp
+  is older than --older-than, or older than --interval-multiplier times the check interval, and
+  delete it. If --archive-index is given the document is copied there before it is deleted. Handlers
+  using --write-mode on-change rewrite a steady document only once a day, so keep --older-than above
+  that and leave --interval-multiplier off.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		if reapOlderThan <= 0 && reapIntervalMultiplier <= 0 {
+			syslogLog.WithFields(logrus.Fields{
+				"check":  "sensupluginses",
+				"client": host,
+			}).Error(`Either --older-than or --interval-multiplier must be given`)
+			sensuutil.Exit("CONFIGERROR")
+		}
+
+		client, err := newEsClient()
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":  "sensupluginses",
+				"client": host,
+				"error":  err,
+				"esHost": esHost,
+				"esPort": esPort,
+			}).Error(`Could not create an elasticsearch client`)
+			sensuutil.Exit("RUNTIMEERROR")
+		}
+
+		ctx := context.Background()
+		stale, noInterval, total, err := findStaleDocuments(ctx, client, time.Now())
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":   "sensupluginses",
+				"client":  host,
+				"error":   err,
+				"esIndex": esIndex,
+			}).Error(`Could not read the status documents`)
+			sensuutil.Exit("RUNTIMEERROR")
+		}
+
+		for _, s := range stale {
+			fmt.Printf("%s/%s\tclient=%s\tcheck=%s\tlast_seen=%s\tage=%s\n",
+				s.index, s.id, s.doc.SensuClient, s.doc.CheckName, s.doc.IncidentTimestamp, s.age)
+		}
+		if noInterval > 0 {
+			fmt.Printf("%d status documents have no check_interval and were kept, use --older-than to reap them\n", noInterval)
+		}
+
+		if reapDryRun {
+			fmt.Printf("%d of %d status documents would be removed from %s\n", len(stale), total, esIndex)
+			return
+		}
+
+		removed, err := removeStaleDocuments(ctx, client, stale)
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":   "sensupluginses",
+				"client":  host,
+				"error":   err,
+				"esIndex": esIndex,
+			}).Error(`Could not remove the stale status documents`)
+		}
+
+		syslogLog.WithFields(logrus.Fields{
+			"check":   "sensupluginses",
+			"client":  host,
+			"esIndex": esIndex,
+			"removed": removed,
+		}).Info(`Stale status documents reaped`)
+		fmt.Printf("%d of %d status documents removed from %s\n", removed, total, esIndex)
+
+		if err != nil {
+			sensuutil.Exit("RUNTIMEERROR")
+		}
+	},
+}
+
+// findStaleDocuments scrolls through the status index and returns every document that has gone stale, the number
+// of documents --interval-multiplier could not judge because they were written without a check_interval and the
+// number of documents examined.
+func findStaleDocuments(ctx context.Context, client *elastic.Client, now time.Time) ([]staleDocument, int, int, error) {
+	var stale []staleDocument
+	noInterval := 0
+	total := 0
+
+	err := eachStatusDocument(ctx, client, func(hit *elastic.SearchHit, doc statusDocument) error {
+		total++
+		age, ok := staleAge(doc, now)
+		if !ok {
+			// only report the documents that --interval-multiplier alone could not judge
+			if _, dated := statusDocumentAge(doc, now); dated && reapOlderThan <= 0 && reapIntervalMultiplier > 0 && doc.CheckInterval <= 0 {
+				noInterval++
+			}
+			return nil
+		}
+
+		var source map[string]interface{}
+		if err := json.Unmarshal(*hit.Source, &source); err != nil {
+			return err
+		}
+		stale = append(stale, staleDocument{index: hit.Index, id: hit.Id, typ: hit.Type, age: age, doc: doc, source: source})
+		return nil
+	})
+	return stale, noInterval, total, err
+}
+
+// staleAge returns how long ago the document was last written and whether that makes it stale. Documents without
+// a usable timestamp are never considered stale.
+func staleAge(doc statusDocument, now time.Time) (time.Duration, bool) {
+	age, ok := statusDocumentAge(doc, now)
+	if !ok {
+		return 0, false
+	}
+
+	if reapOlderThan > 0 && age > reapOlderThan {
+		return age, true
+	}
+	if reapIntervalMultiplier > 0 && doc.CheckInterval > 0 {
+		limit := time.Duration(reapIntervalMultiplier*doc.CheckInterval) * time.Second
+		if age > limit {
+			return age, true
+		}
+	}
+	return age, false
+}
+
+// removeStaleDocuments deletes the given documents from the index they were found in and returns the number of
+// documents deleted. When an archive index was requested the documents are archived first and only those the
+// archive confirmed are deleted.
+func removeStaleDocuments(ctx context.Context, client *elastic.Client, stale []staleDocument) (int, error) {
+	removed := 0
+	reapedAt := time.Now().Format(time.RFC3339)
+
+	for start := 0; start < len(stale); start += 500 {
+		end := start + 500
+		if end > len(stale) {
+			end = len(stale)
+		}
+		batch := stale[start:end]
+
+		var failed []*elastic.BulkResponseItem
+		if reapArchiveIndex != "" {
+			archive := client.Bulk()
+			for _, s := range batch {
+				s.source["reaped_at"] = reapedAt
+				archive.Add(elastic.NewBulkIndexRequest().Index(reapArchiveIndex).Type(s.typ).Id(s.id).Doc(s.source))
+			}
+			res, err := archive.Do(ctx)
+			if err != nil {
+				return removed, err
+			}
+
+			var archived []staleDocument
+			for i, item := range res.Items {
+				for _, result := range item {
+					if result.Status < 200 || result.Status > 299 {
+						failed = append(failed, result)
+						continue
+					}
+					archived = append(archived, batch[i])
+				}
+			}
+			batch = archived
+		}
+
+		if len(batch) > 0 {
+			remove := client.Bulk()
+			for _, s := range batch {
+				remove.Add(elastic.NewBulkDeleteRequest().Index(s.index).Type(s.typ).Id(s.id))
+			}
+			res, err := remove.Do(ctx)
+			if err != nil {
+				return removed, err
+			}
+			removed += len(res.Deleted())
+			failed = append(failed, res.Failed()...)
+		}
+		if len(failed) > 0 {
+			return removed, bulkFailure(failed)
+		}
+	}
+	return removed, nil
+}
+
+func init() {
+	RootCmd.AddCommand(reapCmd)
+
+	// set commandline flags
+	reapCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	reapCmd.Flags().StringVarP(&esIndex, "index", "", StatusEsIndex, "the es index to reap")
+	reapCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	reapCmd.Flags().DurationVarP(&reapOlderThan, "older-than", "", 0, "remove documents not updated within this duration (0 disables)")
+	reapCmd.Flags().IntVarP(&reapIntervalMultiplier, "interval-multiplier", "", 0, "remove documents not updated within this many check intervals (0 disables), documents without a check interval fall back to --older-than")
+	reapCmd.Flags().BoolVarP(&reapDryRun, "dry-run", "", false, "report what would be removed without removing anything")
+	reapCmd.Flags().StringVarP(&reapArchiveIndex, "archive-index", "", "", "copy documents into this index before removing them")
+}
@@ -0,0 +1,546 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"github.com/yieldbot/sensuplugin/sensuutil"
+	"golang.org/x/net/context"
+)
+
+// availability report configuration
+var reportFrom string
+var reportTo string
+var reportBy string
+var reportFormat string
+var reportGap time.Duration
+
+// reportStates are the states time is divided between, in the order they are reported.
+var reportStates = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// checkTimeline is everything known about one status document over the report range.
+type checkTimeline struct {
+	instance  string
+	check     string
+	tags      []string
+	interval  int
+	firstSeen time.Time
+	lastSeen  time.Time
+	incidents []incident
+}
+
+// availability is the share of the observed time a group of checks spent in each state, and the share of the range
+// that was observed, in percent.
+type availability struct {
+	Group     string  `json:"group"`
+	OK        float64 `json:"ok"`
+	Warning   float64 `json:"warning"`
+	Critical  float64 `json:"critical"`
+	Unknown   float64 `json:"unknown"`
+	Coverage  float64 `json:"coverage"`
+	Incidents int     `json:"incidents"`
+	MTTR      int64   `json:"mttr_seconds"`
+
+	seconds  map[string]float64
+	total    float64
+	ranged   float64
+	repaired int64
+	closed   int64
+}
+
+// span is a stretch of time a check spent in one state.
+type span struct {
+	start time.Time
+	end   time.Time
+	state string
+}
+
+// reportCmd groups the reports built from the status and incident indices
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Reports built from the status and incident indices.",
+}
+
+// reportAvailabilityCmd computes availability over a date range
+var reportAvailabilityCmd = &cobra.Command{
+	Use:   "availability --from <date> [--to <date>] [--by check|client-check|tag] [--format table|csv|json]",
+	Short: "Report the percentage of time checks spent OK, WARNING, CRITICAL and UNKNOWN over a date range.",
+	Long: `This will read the incidents recorded by --track-incidents together with the current status
+  documents and work out how much of the range every check, client and check pair or tag spent in
+  each state. Time outside an incident is OK. Silences recorded by --track-incidents, and the
+  time since a check was last heard from, count as UNKNOWN once they last longer than --gap, by
+  default three check intervals. Time before a check was first heard from is left out and the
+  share of the range that was observed is reported as coverage. Dates are given as 2006-01-02 or
+  RFC3339 and the range ends now unless --to is given.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		from, to, err := reportRange(reportFrom, reportTo, time.Now())
+		if err != nil {
+			sensuutil.Exit("CONFIGERROR", err.Error())
+		}
+		group, ok := reportGroupers[reportBy]
+		if !ok {
+			sensuutil.Exit("CONFIGERROR", fmt.Sprintf("invalid --by %q, expected check, client-check or tag", reportBy))
+		}
+		write, ok := reportWriters[reportFormat]
+		if !ok {
+			sensuutil.Exit("CONFIGERROR", fmt.Sprintf("invalid --format %q, expected table, csv or json", reportFormat))
+		}
+
+		client, err := newEsClient()
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":  "sensupluginses",
+				"client": host,
+				"error":  err,
+				"esHost": esHost,
+				"esPort": esPort,
+			}).Error(`Could not create an elasticsearch client`)
+			sensuutil.Exit("RUNTIMEERROR")
+		}
+
+		timelines, err := loadTimelines(context.Background(), client, from, to)
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":         "sensupluginses",
+				"client":        host,
+				"error":         err,
+				"esIndex":       esIndex,
+				"incidentIndex": incidentIndex,
+			}).Error(`Could not read the status documents and incidents`)
+			sensuutil.Exit("RUNTIMEERROR")
+		}
+
+		if err := write(os.Stdout, computeAvailability(timelines, group, from, to)); err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":  "sensupluginses",
+				"client": host,
+				"error":  err,
+			}).Error(`Could not write the report`)
+			sensuutil.Exit("RUNTIMEERROR")
+		}
+	},
+}
+
+// reportRange parses the start and end of the report. An empty end means now.
+func reportRange(fromText string, toText string, now time.Time) (time.Time, time.Time, error) {
+	parse := func(s string) (time.Time, error) {
+		if t, err := time.Parse("2006-01-02", s); err == nil {
+			return t, nil
+		}
+		return time.Parse(time.RFC3339, s)
+	}
+
+	if fromText == "" {
+		return time.Time{}, time.Time{}, fmt.Errorf("--from is required")
+	}
+	from, err := parse(fromText)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid --from %q, expected 2006-01-02 or RFC3339", fromText)
+	}
+	to := now
+	if toText != "" {
+		if to, err = parse(toText); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid --to %q, expected 2006-01-02 or RFC3339", toText)
+		}
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("--from must be before --to")
+	}
+	return from, to, nil
+}
+
+// loadTimelines collects the status documents and the incidents overlapping the range, keyed on the status
+// document they belong to.
+func loadTimelines(ctx context.Context, client *elastic.Client, from time.Time, to time.Time) (map[string]*checkTimeline, error) {
+	timelines := make(map[string]*checkTimeline)
+
+	err := eachStatusDocument(ctx, client, func(hit *elastic.SearchHit, doc statusDocument) error {
+		t := &checkTimeline{instance: doc.MonitoredInstance, check: doc.CheckName, tags: doc.Tags, interval: doc.CheckInterval}
+		if seen, err := time.Parse(time.RFC3339, doc.IncidentTimestamp); err == nil {
+			t.lastSeen = seen
+		}
+		if first, err := time.Parse(time.RFC3339, doc.FirstSeen); err == nil {
+			t.firstSeen = first
+		}
+		timelines[pendingKey(hit.Index, hit.Id)] = t
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query := elastic.NewBoolQuery().
+		Filter(elastic.NewRangeQuery("opened_at").Lte(to.Format(time.RFC3339))).
+		Should(
+			elastic.NewRangeQuery("closed_at").Gte(from.Format(time.RFC3339)),
+			elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery("closed_at")),
+		).
+		MinimumNumberShouldMatch(1)
+	scroll := client.Scroll(incidentIndex).Query(query).Size(500)
+	defer scroll.Clear(ctx)
+
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF || elastic.IsNotFound(err) {
+			return timelines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, hit := range res.Hits.Hits {
+			var inc incident
+			if hit.Source == nil {
+				continue
+			}
+			if err := json.Unmarshal(*hit.Source, &inc); err != nil {
+				return nil, err
+			}
+
+			key := pendingKey(inc.StatusIndex, inc.StatusID)
+			t, ok := timelines[key]
+			if !ok {
+				// the status document has since been reaped
+				t = &checkTimeline{instance: inc.MonitoredInstance, check: inc.CheckName, tags: inc.Tags, interval: inc.CheckInterval}
+				timelines[key] = t
+			}
+			t.incidents = append(t.incidents, inc)
+		}
+	}
+}
+
+// gap returns how long a check may go unheard before its time counts as unknown.
+func (t *checkTimeline) gap() time.Duration {
+	if reportGap > 0 {
+		return reportGap
+	}
+	interval := t.interval
+	if interval <= 0 {
+		interval = 60
+	}
+	return 3 * time.Duration(interval) * time.Second
+}
+
+// observedFrom returns when the check was first heard from: the first_seen of its status document or the opening
+// of its earliest incident, whichever is earlier, and otherwise when it was last heard from.
+func (t *checkTimeline) observedFrom() time.Time {
+	first := t.firstSeen
+	for _, inc := range t.incidents {
+		if opened, err := time.Parse(time.RFC3339, inc.OpenedAt); err == nil && (first.IsZero() || opened.Before(first)) {
+			first = opened
+		}
+	}
+	if first.IsZero() {
+		return t.lastSeen
+	}
+	return first
+}
+
+// spans returns the time spent outside OK: the states of every incident, and the unknown stretches in which the
+// check was not heard from for longer than the gap. Those are the recorded silences, the gaps within incidents and
+// the time since the check was last heard from. Incidents still open end where the check went quiet.
+func (t *checkTimeline) spans(to time.Time) ([]span, []span) {
+	var states, unknown []span
+	var heard time.Time
+	gap := t.gap()
+
+	silent := func(from string, until string) {
+		start, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return
+		}
+		if end, err := time.Parse(time.RFC3339, until); err == nil {
+			unknown = append(unknown, span{start: start.Add(gap), end: end, state: "UNKNOWN"})
+		}
+	}
+
+	for _, inc := range t.incidents {
+		opened, err := time.Parse(time.RFC3339, inc.OpenedAt)
+		if err != nil {
+			continue
+		}
+		if seen, err := time.Parse(time.RFC3339, inc.LastSeen); err == nil && seen.After(heard) {
+			heard = seen
+		}
+		if inc.Silence {
+			silent(inc.OpenedAt, inc.ClosedAt)
+			continue
+		}
+		for _, g := range inc.Gaps {
+			silent(g.From, g.To)
+		}
+
+		end := to
+		if closed, err := time.Parse(time.RFC3339, inc.ClosedAt); err == nil {
+			end = closed
+		} else if seen, err := time.Parse(time.RFC3339, inc.LastSeen); err == nil && seen.Add(gap).Before(end) {
+			end = seen.Add(gap)
+		}
+
+		// incidents recorded before transitions were kept spend their whole duration in their worst state
+		transitions := inc.Transitions
+		if len(transitions) == 0 {
+			transitions = []incidentTransition{{State: inc.WorstState, At: inc.OpenedAt}}
+		}
+		for i, tr := range transitions {
+			start, err := time.Parse(time.RFC3339, tr.At)
+			if err != nil || start.Before(opened) {
+				start = opened
+			}
+			stop := end
+			if i+1 < len(transitions) {
+				if next, err := time.Parse(time.RFC3339, transitions[i+1].At); err == nil && next.Before(end) {
+					stop = next
+				}
+			}
+			states = append(states, span{start: start, end: stop, state: reportState(tr.State)})
+		}
+	}
+
+	if t.lastSeen.After(heard) {
+		heard = t.lastSeen
+	}
+	if !heard.IsZero() {
+		unknown = append(unknown, span{start: heard.Add(gap), end: to, state: "UNKNOWN"})
+	}
+	return states, unknown
+}
+
+// reportState folds the check states into those reported, counting anything unexpected as unknown.
+func reportState(state string) string {
+	if containsString(reportStates, state) {
+		return state
+	}
+	return "UNKNOWN"
+}
+
+// seconds divides the observed part of the range between the states and returns it along with how many seconds
+// were observed. Unknown stretches take precedence over the state of an incident they fall within.
+func (t *checkTimeline) seconds(from time.Time, to time.Time) (map[string]float64, float64) {
+	seconds := make(map[string]float64)
+	if first := t.observedFrom(); first.After(from) {
+		from = first
+	}
+	if !from.Before(to) {
+		return seconds, 0
+	}
+	states, unknown := t.spans(to)
+
+	accounted := 0.0
+	for _, u := range unknown {
+		d := overlap(u.start, u.end, from, to)
+		seconds["UNKNOWN"] += d
+		accounted += d
+	}
+	for _, s := range states {
+		d := overlap(s.start, s.end, from, to)
+		for _, u := range unknown {
+			d -= overlap(s.start, s.end, laterOf(from, u.start), earlierOf(to, u.end))
+		}
+		seconds[s.state] += d
+		accounted += d
+	}
+
+	observed := to.Sub(from).Seconds()
+	seconds["OK"] += observed - accounted
+	return seconds, observed
+}
+
+// laterOf returns the later of two times.
+func laterOf(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// earlierOf returns the earlier of two times.
+func earlierOf(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// overlap returns how many seconds of [start, end) fall within [from, to).
+func overlap(start time.Time, end time.Time, from time.Time, to time.Time) float64 {
+	if start.Before(from) {
+		start = from
+	}
+	if end.After(to) {
+		end = to
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start).Seconds()
+}
+
+// reportGroupers name the groups a check is reported under.
+var reportGroupers = map[string]func(*checkTimeline) []string{
+	"check": func(t *checkTimeline) []string {
+		return []string{t.check}
+	},
+	"client-check": func(t *checkTimeline) []string {
+		return []string{t.instance + "/" + t.check}
+	},
+	"tag": func(t *checkTimeline) []string {
+		if len(t.tags) == 0 {
+			return []string{"untagged"}
+		}
+		return t.tags
+	},
+}
+
+// computeAvailability adds up the observed time of every check per group and turns it into percentages, along with
+// the number of incidents and the mean time to repair of those closed within the range.
+func computeAvailability(timelines map[string]*checkTimeline, group func(*checkTimeline) []string, from time.Time, to time.Time) []*availability {
+	groups := make(map[string]*availability)
+
+	for _, t := range timelines {
+		seconds, observed := t.seconds(from, to)
+		for _, name := range group(t) {
+			a, ok := groups[name]
+			if !ok {
+				a = &availability{Group: name, seconds: make(map[string]float64)}
+				groups[name] = a
+			}
+			for state, s := range seconds {
+				a.seconds[state] += s
+			}
+			a.total += observed
+			a.ranged += to.Sub(from).Seconds()
+
+			for _, inc := range t.incidents {
+				if inc.Silence {
+					continue
+				}
+				a.Incidents++
+				if closed, err := time.Parse(time.RFC3339, inc.ClosedAt); err == nil && !closed.Before(from) && !closed.After(to) {
+					a.repaired += inc.Duration
+					a.closed++
+				}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := make([]*availability, 0, len(names))
+	for _, name := range names {
+		a := groups[name]
+		percent := func(state string) float64 {
+			if a.total <= 0 {
+				return 0
+			}
+			return 100 * a.seconds[state] / a.total
+		}
+		a.OK, a.Warning, a.Critical, a.Unknown = percent("OK"), percent("WARNING"), percent("CRITICAL"), percent("UNKNOWN")
+		a.Coverage = 100 * a.total / a.ranged
+		if a.closed > 0 {
+			a.MTTR = a.repaired / a.closed
+		}
+		report = append(report, a)
+	}
+	return report
+}
+
+// reportWriters write the report in each of the supported formats.
+var reportWriters = map[string]func(io.Writer, []*availability) error{
+	"table": writeAvailabilityTable,
+	"csv":   writeAvailabilityCSV,
+	"json": func(w io.Writer, report []*availability) error {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	},
+}
+
+// writeAvailabilityTable writes the report as aligned columns.
+func writeAvailabilityTable(w io.Writer, report []*availability) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tOK %\tWARNING %\tCRITICAL %\tUNKNOWN %\tCOVERAGE %\tINCIDENTS\tMTTR")
+	for _, a := range report {
+		mttr := "-"
+		if a.closed > 0 {
+			mttr = (time.Duration(a.MTTR) * time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%d\t%s\n", a.Group, a.OK, a.Warning, a.Critical, a.Unknown, a.Coverage, a.Incidents, mttr)
+	}
+	return tw.Flush()
+}
+
+// writeAvailabilityCSV writes the report as comma separated values with a header row.
+func writeAvailabilityCSV(w io.Writer, report []*availability) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"group", "ok", "warning", "critical", "unknown", "coverage", "incidents", "mttr_seconds"})
+	for _, a := range report {
+		cw.Write([]string{
+			a.Group,
+			strconv.FormatFloat(a.OK, 'f', 3, 64),
+			strconv.FormatFloat(a.Warning, 'f', 3, 64),
+			strconv.FormatFloat(a.Critical, 'f', 3, 64),
+			strconv.FormatFloat(a.Unknown, 'f', 3, 64),
+			strconv.FormatFloat(a.Coverage, 'f', 3, 64),
+			strconv.Itoa(a.Incidents),
+			strconv.FormatInt(a.MTTR, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func init() {
+	RootCmd.AddCommand(reportCmd)
+	reportCmd.AddCommand(reportAvailabilityCmd)
+
+	// set commandline flags
+	reportAvailabilityCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	reportAvailabilityCmd.Flags().StringVarP(&esIndex, "index", "", StatusEsIndex, "the status index, a pattern covering every routed index")
+	reportAvailabilityCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	reportAvailabilityCmd.Flags().StringVarP(&incidentIndex, "incident-index", "", IncidentsEsIndex, "the es index incidents are kept in")
+	reportAvailabilityCmd.Flags().StringVarP(&reportFrom, "from", "", "", "the start of the range, 2006-01-02 or RFC3339")
+	reportAvailabilityCmd.Flags().StringVarP(&reportTo, "to", "", "", "the end of the range, 2006-01-02 or RFC3339 (default now)")
+	reportAvailabilityCmd.Flags().StringVarP(&reportBy, "by", "", "check", "group by check, client-check or tag")
+	reportAvailabilityCmd.Flags().StringVarP(&reportFormat, "format", "", "table", "table, csv or json")
+	reportAvailabilityCmd.Flags().DurationVarP(&reportGap, "gap", "", 0, "how long a check may go unheard before the silence counts as unknown (default three check intervals)")
+}
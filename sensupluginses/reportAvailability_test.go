@@ -0,0 +1,168 @@
+package sensupluginses
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOverlap(t *testing.T) {
+	base := time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(m int) time.Time { return base.Add(time.Duration(m) * time.Minute) }
+
+	tests := []struct {
+		name       string
+		start, end int
+		want       float64
+	}{
+		{"inside", 10, 20, 600},
+		{"starts before", -10, 20, 1200},
+		{"ends after", 50, 90, 600},
+		{"covers", -10, 90, 3600},
+		{"before", -20, -10, 0},
+		{"after", 70, 80, 0},
+		{"reversed", 20, 10, 0},
+	}
+
+	for _, tt := range tests {
+		if got := overlap(at(tt.start), at(tt.end), at(0), at(60)); got != tt.want {
+			t.Errorf("%s: overlap = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTimelineSeconds(t *testing.T) {
+	base := time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(m int) time.Time { return base.Add(time.Duration(m) * time.Minute) }
+	stamp := func(m int) string { return at(m).Format(time.RFC3339) }
+	from, to := at(0), at(600)
+
+	tests := []struct {
+		name      string
+		firstSeen string
+		lastSeen  int
+		incs      []incident
+		want      map[string]float64
+		observed  float64
+	}{
+		{
+			name:      "always ok",
+			firstSeen: stamp(-100),
+			lastSeen:  600,
+			want:      map[string]float64{"OK": 36000},
+			observed:  36000,
+		},
+		{
+			name:      "closed incident with transitions",
+			firstSeen: stamp(-100),
+			lastSeen:  600,
+			incs: []incident{{
+				OpenedAt: stamp(60), ClosedAt: stamp(120), LastSeen: stamp(120), WorstState: "CRITICAL",
+				Transitions: []incidentTransition{{State: "WARNING", At: stamp(60)}, {State: "CRITICAL", At: stamp(90)}},
+			}},
+			want:     map[string]float64{"OK": 32400, "WARNING": 1800, "CRITICAL": 1800},
+			observed: 36000,
+		},
+		{
+			name:      "incident without transitions",
+			firstSeen: stamp(-100),
+			lastSeen:  600,
+			incs:      []incident{{OpenedAt: stamp(60), ClosedAt: stamp(120), LastSeen: stamp(120), WorstState: "WARNING"}},
+			want:      map[string]float64{"OK": 32400, "WARNING": 3600},
+			observed:  36000,
+		},
+		{
+			name:      "incident opened before the range",
+			firstSeen: stamp(-100),
+			lastSeen:  600,
+			incs:      []incident{{OpenedAt: stamp(-60), ClosedAt: stamp(60), LastSeen: stamp(60), WorstState: "CRITICAL"}},
+			want:      map[string]float64{"OK": 32400, "CRITICAL": 3600},
+			observed:  36000,
+		},
+		{
+			name:      "quiet until the end",
+			firstSeen: stamp(-100),
+			lastSeen:  480,
+			want:      map[string]float64{"OK": 28980, "UNKNOWN": 7020},
+			observed:  36000,
+		},
+		{
+			name:      "open incident then quiet",
+			firstSeen: stamp(-100),
+			lastSeen:  570,
+			incs:      []incident{{OpenedAt: stamp(540), LastSeen: stamp(570), WorstState: "CRITICAL"}},
+			want:      map[string]float64{"OK": 32400, "CRITICAL": 1980, "UNKNOWN": 1620},
+			observed:  36000,
+		},
+		{
+			name:      "unexpected state",
+			firstSeen: stamp(-100),
+			lastSeen:  600,
+			incs:      []incident{{OpenedAt: stamp(0), ClosedAt: stamp(10), LastSeen: stamp(10), WorstState: "PENDING"}},
+			want:      map[string]float64{"OK": 35400, "UNKNOWN": 600},
+			observed:  36000,
+		},
+		{
+			name:      "first seen within the range",
+			firstSeen: stamp(100),
+			lastSeen:  600,
+			want:      map[string]float64{"OK": 30000},
+			observed:  30000,
+		},
+		{
+			name:     "observed from the earliest incident without first seen",
+			lastSeen: 600,
+			incs:     []incident{{OpenedAt: stamp(300), ClosedAt: stamp(360), LastSeen: stamp(360), WorstState: "WARNING"}},
+			want:     map[string]float64{"OK": 14400, "WARNING": 3600},
+			observed: 18000,
+		},
+		{
+			name:     "observed from the last event without first seen or incidents",
+			lastSeen: 700,
+			want:     map[string]float64{},
+			observed: 0,
+		},
+		{
+			name:      "recorded silence",
+			firstSeen: stamp(-100),
+			lastSeen:  600,
+			incs:      []incident{{OpenedAt: stamp(100), ClosedAt: stamp(200), LastSeen: stamp(100), WorstState: "UNKNOWN", Silence: true}},
+			want:      map[string]float64{"OK": 30180, "UNKNOWN": 5820},
+			observed:  36000,
+		},
+		{
+			name:      "silence shorter than the gap",
+			firstSeen: stamp(-100),
+			lastSeen:  600,
+			incs:      []incident{{OpenedAt: stamp(100), ClosedAt: stamp(102), LastSeen: stamp(100), WorstState: "UNKNOWN", Silence: true}},
+			want:      map[string]float64{"OK": 36000},
+			observed:  36000,
+		},
+		{
+			name:      "gap within an incident",
+			firstSeen: stamp(-100),
+			lastSeen:  600,
+			incs: []incident{{
+				OpenedAt: stamp(60), ClosedAt: stamp(180), LastSeen: stamp(180), WorstState: "CRITICAL",
+				Gaps: []incidentGap{{From: stamp(90), To: stamp(150)}},
+			}},
+			want:     map[string]float64{"OK": 28800, "CRITICAL": 3780, "UNKNOWN": 3420},
+			observed: 36000,
+		},
+	}
+
+	for _, tt := range tests {
+		timeline := &checkTimeline{interval: 60, lastSeen: at(tt.lastSeen), incidents: tt.incs}
+		if tt.firstSeen != "" {
+			timeline.firstSeen, _ = time.Parse(time.RFC3339, tt.firstSeen)
+		}
+		got, observed := timeline.seconds(from, to)
+		for _, state := range reportStates {
+			if got[state] != tt.want[state] {
+				t.Errorf("%s: %s = %v seconds, want %v", tt.name, state, got[state], tt.want[state])
+			}
+		}
+		if observed != tt.observed {
+			t.Errorf("%s: observed = %v seconds, want %v", tt.name, observed, tt.observed)
+		}
+	}
+}
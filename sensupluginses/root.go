@@ -39,6 +39,10 @@ var cfgFile string
 // Hostname for logging
 var host string
 
+// Sensu client socket for checks reporting a result per entity
+var sensuSocket string
+var sensuCheckName string
+
 // Create a logging instance.
 var syslogLog = logrus.New()
 
@@ -0,0 +1,141 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/yieldbot/sensuplugin/sensuhandler"
+)
+
+// routeConfig is a routing rule as written in the routes section of the config file.
+type routeConfig struct {
+	Environments  []string `mapstructure:"environments"`
+	Tags          []string `mapstructure:"tags"`
+	Subscriptions []string `mapstructure:"subscriptions"`
+	CheckName     string   `mapstructure:"check_name"`
+	Index         string   `mapstructure:"index"`
+}
+
+// routeRule sends the documents of matching events to an index. Every condition given must match; a list matches
+// when any of its entries does.
+type routeRule struct {
+	environments  []string
+	tags          []string
+	subscriptions []string
+	checkName     *regexp.Regexp
+	text          string
+	index         *template.Template
+}
+
+// router picks the index of a status document. The first matching rule wins and events no rule matches go to the
+// default index.
+type router struct {
+	rules []routeRule
+}
+
+// loadRouter reads the routing rules from the routes section of the config file.
+func loadRouter() (*router, error) {
+	var routes []routeConfig
+	if err := viper.UnmarshalKey("routes", &routes); err != nil {
+		return nil, fmt.Errorf("invalid routes: %v", err)
+	}
+
+	r := &router{}
+	for i, route := range routes {
+		if route.Index == "" {
+			return nil, fmt.Errorf("route %d has no index", i+1)
+		}
+		rule := routeRule{
+			environments:  route.Environments,
+			tags:          route.Tags,
+			subscriptions: route.Subscriptions,
+			text:          route.Index,
+		}
+
+		var err error
+		if route.CheckName != "" {
+			if rule.checkName, err = regexp.Compile(route.CheckName); err != nil {
+				return nil, fmt.Errorf("route %d has an invalid check name pattern %q: %v", i+1, route.CheckName, err)
+			}
+		}
+		if rule.index, err = template.New("index").Funcs(docIDFuncs).Parse(route.Index); err != nil {
+			return nil, fmt.Errorf("route %d has an invalid index template %q: %v", i+1, route.Index, err)
+		}
+		if err := rule.index.Execute(new(bytes.Buffer), docIDFields{}); err != nil {
+			return nil, fmt.Errorf("route %d has an invalid index template %q: %v", i+1, route.Index, err)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// matches reports whether an event meets every condition of the rule.
+func (rule *routeRule) matches(event *sensuhandler.SensuEvent, f docIDFields) bool {
+	if len(rule.environments) > 0 && !containsString(rule.environments, f.Env) {
+		return false
+	}
+	if len(rule.tags) > 0 && !containsAny(event.Check.Tags, rule.tags) {
+		return false
+	}
+	if len(rule.subscriptions) > 0 && !containsAny(event.Client.Subscriptions, rule.subscriptions) {
+		return false
+	}
+	if rule.checkName != nil && !rule.checkName.MatchString(event.Check.Name) {
+		return false
+	}
+	return true
+}
+
+// route returns the index the status document of an event belongs in. Index names are lowercased since
+// elasticsearch rejects anything else. A template that renders nothing falls back to the default index.
+func (r *router) route(event *sensuhandler.SensuEvent, env *sensuhandler.EnvDetails, defaultIndex string) string {
+	f := eventIDFields(event, env)
+	for _, rule := range r.rules {
+		if !rule.matches(event, f) {
+			continue
+		}
+
+		var buf bytes.Buffer
+		err := rule.index.Execute(&buf, f)
+		if err == nil && buf.Len() == 0 {
+			err = fmt.Errorf("the index template rendered an empty name")
+		}
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":      "sensupluginses",
+				"client":     host,
+				"error":      err,
+				"route":      rule.text,
+				"sensuCheck": event.Check.Name,
+			}).Error(`Could not render the index of a route, using the default index`)
+			return defaultIndex
+		}
+		return strings.ToLower(buf.String())
+	}
+	return defaultIndex
+}
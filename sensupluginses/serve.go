@@ -0,0 +1,580 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/yieldbot/sensuplugin/sensuhandler"
+	"github.com/yieldbot/sensuplugin/sensuutil"
+	"golang.org/x/net/context"
+)
+
+// serve configuration
+var serveTCP string
+var serveUDP string
+var serveWorkers int
+var serveBulkActions int
+var serveBulkSize int
+var serveFlushInterval time.Duration
+var serveQueueSize int
+
+// eventServer accepts sensu events over the handler sockets and indexes their status documents in bulk.
+type eventServer struct {
+	stats     serverStats
+	sinkMu    sync.RWMutex
+	sink      sinkConfig
+	client    *elastic.Client
+	processor *elastic.BulkProcessor
+	env       *sensuhandler.EnvDetails
+	queue     chan *sensuhandler.SensuEvent
+	done      chan struct{}
+	config    atomic.Value
+	flags     *pflag.FlagSet
+	listeners []io.Closer
+	connsMu   sync.Mutex
+	conns     map[net.Conn]bool
+	readers   sync.WaitGroup
+	indexed   sync.WaitGroup
+	pendingMu sync.Mutex
+	pending   map[string]*spooledDocument
+	indicesMu sync.Mutex
+	indices   map[string]bool
+	mode      writeMode
+	writes    *writeCache
+	incidents *incidentTracker
+}
+
+// serveCmd runs the handler as a long lived daemon
+var serveCmd = &cobra.Command{
+	Use:   "serve --tcp <address> --udp <address> --index <index> --host <host> --port <port>",
+	Short: "Accept sensu events over a TCP or UDP handler socket and index them in bulk.",
+	Long: `Sensu starts a new handler process for every event, which means a new client, an index exists
+  call and a single document request each time. This will instead accept events from a sensu tcp or
+  udp handler and write them through a bulk processor, flushing every --bulk-actions documents,
+  --bulk-size bytes or --flush-interval. At most --queue-size events wait to be indexed; beyond that
+  the sockets stop reading until the cluster catches up. The documents written are exactly those of
+  handlerElasticsearchStatus.
+
+  The serve section of the config file is reread when it changes or on SIGHUP, including the
+  elasticsearch host, port and bulk settings. On SIGINT or SIGTERM the sockets and open connections
+  are closed and pending documents are flushed for up to --drain-timeout; anything not indexed by
+  then is written to --spool-dir and indexed when the server next starts.`,
+
+	Run: func(sensupluginses *cobra.Command, args []string) {
+
+		if serveTCP == "" && serveUDP == "" {
+			sensuutil.Exit("CONFIGERROR", "At least one of --tcp and --udp must be given")
+		}
+
+		cfg, err := loadServeConfig(sensupluginses.Flags())
+		if err != nil {
+			sensuutil.Exit("CONFIGERROR", err.Error())
+		}
+		mode, err := parseWriteMode(writeModeFlag)
+		if err != nil {
+			sensuutil.Exit("CONFIGERROR", err.Error())
+		}
+
+		s := &eventServer{
+			env:     sensuEnv.SetSensuEnv(),
+			queue:   make(chan *sensuhandler.SensuEvent, serveQueueSize),
+			done:    make(chan struct{}),
+			pending: make(map[string]*spooledDocument),
+			indices: make(map[string]bool),
+			conns:   make(map[net.Conn]bool),
+			flags:   sensupluginses.Flags(),
+			mode:    mode,
+			writes:  loadWriteCache(writeCachePath),
+		}
+		s.config.Store(cfg)
+		if trackIncidents {
+			s.incidents = newIncidentTracker(nil, !mode.onChange)
+		}
+		if err := s.start(); err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":   "sensupluginses",
+				"client":  host,
+				"error":   err,
+				"esHost":  cfg.sink.host,
+				"esPort":  cfg.sink.port,
+				"esIndex": cfg.index,
+			}).Error(`Could not start the event server`)
+			sensuutil.Exit("RUNTIMEERROR")
+		}
+
+		var changes chan fsnotify.Event
+		watcher, err := watchConfig()
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":      "sensupluginses",
+				"client":     host,
+				"error":      err,
+				"configFile": viper.ConfigFileUsed(),
+			}).Error(`Could not watch the config file, only SIGHUP will reload it`)
+		}
+		if watcher != nil {
+			defer watcher.Close()
+			changes = watcher.Events
+		}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		for {
+			select {
+			case event := <-changes:
+				if isConfigChange(event) {
+					s.reload("config file changed")
+				}
+			case sig := <-signals:
+				if sig == syscall.SIGHUP {
+					s.reload("SIGHUP")
+					continue
+				}
+				s.stop()
+				return
+			}
+		}
+	},
+}
+
+// start connects to elasticsearch, prepares the index, replays the spool then opens the handler sockets.
+func (s *eventServer) start() error {
+	if err := s.connect(s.currentConfig().sink); err != nil {
+		return err
+	}
+	if err := s.ensureIndex(s.currentConfig().index); err != nil {
+		return err
+	}
+	if s.incidents != nil {
+		if err := s.ensureIndex(incidentIndex); err != nil {
+			return err
+		}
+	}
+	s.replaySpool()
+
+	s.indexed.Add(1)
+	go s.dispatch()
+
+	if serveTCP != "" {
+		if err := s.listenTCP(serveTCP); err != nil {
+			return err
+		}
+	}
+	if serveUDP != "" {
+		if err := s.listenUDP(serveUDP); err != nil {
+			return err
+		}
+	}
+	if serveHTTP != "" {
+		if err := s.listenHTTP(serveHTTP); err != nil {
+			return err
+		}
+	}
+
+	syslogLog.WithFields(logrus.Fields{
+		"check":   "sensupluginses",
+		"client":  host,
+		"tcp":     serveTCP,
+		"udp":     serveUDP,
+		"http":    serveHTTP,
+		"esHost":  s.currentConfig().sink.host,
+		"esPort":  s.currentConfig().sink.port,
+		"esIndex": s.currentConfig().index,
+	}).Info(`Accepting sensu events`)
+	return nil
+}
+
+// connect creates a client and bulk processor for the sink and switches to them. A processor already running is
+// closed in the background, which flushes what it still holds; stop waits for it along with the dispatcher.
+func (s *eventServer) connect(sink sinkConfig) error {
+	client, err := esClientFor(sink.host, sink.port)
+	if err != nil {
+		return err
+	}
+	processor, err := client.BulkProcessor().
+		Name("sensupluginses").
+		Workers(sink.workers).
+		BulkActions(sink.bulkActions).
+		BulkSize(sink.bulkSize).
+		FlushInterval(sink.flushInterval).
+		Before(s.beforeBulk).
+		After(s.afterBulk).
+		Stats(true).
+		Do()
+	if err != nil {
+		return err
+	}
+
+	s.sinkMu.Lock()
+	previous := s.processor
+	s.sink, s.client, s.processor = sink, client, processor
+	s.sinkMu.Unlock()
+
+	s.indicesMu.Lock()
+	s.indices = make(map[string]bool)
+	s.indicesMu.Unlock()
+	if s.incidents != nil {
+		s.incidents.setClient(client)
+	}
+
+	if previous != nil {
+		s.indexed.Add(1)
+		go func() {
+			defer s.indexed.Done()
+			previous.Close()
+		}()
+	}
+	return nil
+}
+
+// currentSink returns the sink the server is connected to.
+func (s *eventServer) currentSink() sinkConfig {
+	s.sinkMu.RLock()
+	defer s.sinkMu.RUnlock()
+	return s.sink
+}
+
+// currentClient returns the client of the current sink.
+func (s *eventServer) currentClient() *elastic.Client {
+	s.sinkMu.RLock()
+	defer s.sinkMu.RUnlock()
+	return s.client
+}
+
+// add hands a document to the bulk processor of the current sink.
+func (s *eventServer) add(d *spooledDocument) {
+	s.sinkMu.RLock()
+	defer s.sinkMu.RUnlock()
+	s.processor.Add(s.track(d))
+}
+
+// stop closes the sockets and flushes every event already received to the bulk processor. Whatever elasticsearch
+// has not acknowledged within the drain timeout is spooled.
+func (s *eventServer) stop() {
+	close(s.done)
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.connsMu.Lock()
+	for conn := range s.conns {
+		// wake up readers blocked on idle connections rather than waiting out their read deadline
+		conn.SetReadDeadline(time.Now())
+	}
+	s.connsMu.Unlock()
+	s.readers.Wait()
+	close(s.queue)
+
+	flushed := make(chan error, 1)
+	go func() {
+		s.indexed.Wait()
+		s.sinkMu.RLock()
+		defer s.sinkMu.RUnlock()
+		flushed <- s.processor.Close()
+	}()
+
+	select {
+	case err := <-flushed:
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":   "sensupluginses",
+				"client":  host,
+				"error":   err,
+				"esIndex": s.currentConfig().index,
+			}).Error(`Could not flush the pending documents`)
+		}
+	case <-time.After(serveDrainTimeout):
+		syslogLog.WithFields(logrus.Fields{
+			"check":        "sensupluginses",
+			"client":       host,
+			"drainTimeout": serveDrainTimeout,
+			"esIndex":      s.currentConfig().index,
+		}).Error(`The pending documents were not indexed in time`)
+		for event := range s.queue {
+			for _, d := range s.documents(event) {
+				s.track(d)
+			}
+		}
+	}
+	s.writeSpool()
+
+	if s.mode.onChange {
+		if err := s.writes.save(time.Now()); err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":      "sensupluginses",
+				"client":     host,
+				"error":      err,
+				"writeCache": writeCachePath,
+			}).Error(`Could not save the write cache`)
+		}
+	}
+}
+
+// listenTCP accepts connections from a sensu tcp handler. Each connection carries one or more events.
+func (s *eventServer) listenTCP(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.listeners = append(s.listeners, l)
+
+	s.readers.Add(1)
+	go func() {
+		defer s.readers.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if !s.openConn(conn) {
+				conn.Close()
+				return
+			}
+			s.readers.Add(1)
+			go func() {
+				defer s.readers.Done()
+				defer s.closeConn(conn)
+				conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+				s.decodeEvents(conn, conn.RemoteAddr().String())
+			}()
+		}
+	}()
+	return nil
+}
+
+// openConn registers an accepted connection so stop can interrupt it. It reports false once the server is stopping.
+func (s *eventServer) openConn(conn net.Conn) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	s.conns[conn] = true
+	return true
+}
+
+// closeConn closes a connection and forgets it.
+func (s *eventServer) closeConn(conn net.Conn) {
+	s.connsMu.Lock()
+	delete(s.conns, conn)
+	s.connsMu.Unlock()
+	conn.Close()
+}
+
+// listenUDP reads events sent by a sensu udp handler, one per datagram.
+func (s *eventServer) listenUDP(address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	s.listeners = append(s.listeners, conn)
+
+	s.readers.Add(1)
+	go func() {
+		defer s.readers.Done()
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			s.decodeEvents(bytes.NewReader(buf[:n]), from.String())
+		}
+	}()
+	return nil
+}
+
+// decodeEvents reads every event from r and queues it for indexing.
+func (s *eventServer) decodeEvents(r io.Reader, from string) {
+	dec := json.NewDecoder(r)
+	for {
+		event := new(sensuhandler.SensuEvent)
+		err := dec.Decode(event)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			select {
+			case <-s.done:
+				// the connection was interrupted because the server is stopping
+				return
+			default:
+			}
+			atomic.AddInt64(&s.stats.decodeErrors, 1)
+			syslogLog.WithFields(logrus.Fields{
+				"check":  "sensupluginses",
+				"client": host,
+				"error":  err,
+				"from":   from,
+			}).Error(`Could not decode a sensu event`)
+			return
+		}
+		atomic.AddInt64(&s.stats.received, 1)
+		if !s.enqueue(event) {
+			return
+		}
+	}
+}
+
+// enqueue waits for room in the queue, which is what pushes back on the sockets when elasticsearch falls behind.
+// It reports false once the server is stopping.
+func (s *eventServer) enqueue(event *sensuhandler.SensuEvent) bool {
+	select {
+	case s.queue <- event:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// dispatch turns queued events into status documents for the bulk processor.
+func (s *eventServer) dispatch() {
+	defer s.indexed.Done()
+	for event := range s.queue {
+		for _, d := range s.documents(event) {
+			s.add(d)
+		}
+	}
+}
+
+// documents builds the documents to write for an event with the current configuration: the status document and,
+// when incidents are tracked, any silence before it and the incident it belongs to, in that order. Events the
+// filter drops write nothing.
+func (s *eventServer) documents(event *sensuhandler.SensuEvent) []*spooledDocument {
+	cfg := s.currentConfig()
+	if ok, _ := cfg.filter.allow(event, s.env); !ok {
+		atomic.AddInt64(&s.stats.filtered, 1)
+		return nil
+	}
+	index := cfg.routes.route(event, s.env, cfg.index)
+	if err := s.ensureIndex(index); err != nil {
+		syslogLog.WithFields(logrus.Fields{
+			"check":   "sensupluginses",
+			"client":  host,
+			"error":   err,
+			"esIndex": index,
+		}).Error(`Could not create an elasticsearch index`)
+	}
+	docID, doc := createStatusDocument(event, s.env, cfg.ids, cfg.redact, cfg.fields)
+
+	var incidents []*incident
+	if s.incidents != nil {
+		var err error
+		incidents, err = s.incidents.observe(context.Background(), index, docID, doc, eventTime(event.Check.Issued), cfg.filter.silentAfter(event.Check.Interval))
+		if err != nil {
+			syslogLog.WithFields(logrus.Fields{
+				"check":         "sensupluginses",
+				"client":        host,
+				"error":         err,
+				"incidentIndex": incidentIndex,
+				"sensuCheck":    event.Check.Name,
+			}).Error(`Could not record the incident`)
+		}
+	}
+
+	var docs []*spooledDocument
+	if s.writes.shouldWrite(s.mode, pendingKey(index, docID), doc, time.Now()) {
+		docs = append(docs, &spooledDocument{Index: index, Type: esType, ID: docID, Version: statusVersion(event), Doc: doc})
+	} else {
+		atomic.AddInt64(&s.stats.unchanged, 1)
+	}
+	for _, inc := range incidents {
+		docs = append(docs, &spooledDocument{Index: incidentIndex, Type: incidentType, ID: inc.ID, Version: int64(inc.EventCount), Doc: inc.document()})
+	}
+	return docs
+}
+
+// ensureIndex creates an index the first time a document is routed to it. Indices already known to exist are not
+// asked about again.
+func (s *eventServer) ensureIndex(index string) error {
+	s.indicesMu.Lock()
+	defer s.indicesMu.Unlock()
+
+	if s.indices[index] {
+		return nil
+	}
+	if err := ensureIndex(context.Background(), s.currentClient(), index); err != nil {
+		return err
+	}
+	s.indices[index] = true
+	return nil
+}
+
+// afterBulk records the outcome of a bulk request and logs those that failed as a whole or in part.
+func (s *eventServer) afterBulk(executionID int64, requests []elastic.BulkableRequest, res *elastic.BulkResponse, err error) {
+	s.observeBulk(executionID, requests, res, err)
+	if res != nil {
+		s.acknowledge(requests, res)
+	}
+
+	if err == nil && res != nil {
+		if failed := bulkRejected(res); len(failed) > 0 {
+			err = bulkFailure(failed)
+		}
+	}
+	if err != nil {
+		syslogLog.WithFields(logrus.Fields{
+			"check":    "sensupluginses",
+			"client":   host,
+			"error":    err,
+			"esIndex":  s.currentConfig().index,
+			"requests": len(requests),
+		}).Error(`Could not index a bulk request`)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+
+	// set commandline flags
+	serveCmd.Flags().StringVarP(&esHost, "host", "", DefaultEsHost, "the elasticsearch host")
+	serveCmd.Flags().StringVarP(&esIndex, "index", "", StatusEsIndex, "the es index to populate")
+	serveCmd.Flags().StringVarP(&esPort, "port", "", DefaultEsPort, "the elasticsearch port")
+	serveCmd.Flags().StringVarP(&serveTCP, "tcp", "", "localhost:3031", "the address to accept sensu tcp handler connections on")
+	serveCmd.Flags().StringVarP(&serveUDP, "udp", "", "", "the address to accept sensu udp handler datagrams on")
+	serveCmd.Flags().IntVarP(&serveWorkers, "workers", "", 2, "the number of concurrent bulk requests")
+	serveCmd.Flags().IntVarP(&serveBulkActions, "bulk-actions", "", 500, "flush after this many documents")
+	serveCmd.Flags().IntVarP(&serveBulkSize, "bulk-size", "", 5<<20, "flush after this many bytes")
+	serveCmd.Flags().DurationVarP(&serveFlushInterval, "flush-interval", "", 5*time.Second, "flush at least this often")
+	serveCmd.Flags().IntVarP(&serveQueueSize, "queue-size", "", 10000, "the number of events that may wait to be indexed")
+	addEventFilterFlags(serveCmd)
+	addWriteModeFlags(serveCmd)
+	addDocIDFlags(serveCmd)
+	addRedactFlags(serveCmd)
+	addIncidentFlags(serveCmd)
+}
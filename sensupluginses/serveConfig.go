@@ -0,0 +1,189 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// serveConfig holds the part of the serve configuration that can change without a restart. It is read from the
+// serve section of sensupluginses.yaml, falling back to the commandline flags for anything the file leaves out.
+type serveConfig struct {
+	index  string
+	sink   sinkConfig
+	filter *eventFilter
+	ids    *docIDTemplate
+	routes *router
+	redact *redactor
+	fields fieldMapping
+}
+
+// sinkConfig is where and how documents are sent. A change reconnects to elasticsearch with a new bulk processor.
+type sinkConfig struct {
+	host          string
+	port          string
+	workers       int
+	bulkActions   int
+	bulkSize      int
+	flushInterval time.Duration
+}
+
+// loadServeConfig builds the serve configuration from the flags and the config file most recently read by viper.
+// Flags given on the commandline take precedence over the config file.
+func loadServeConfig(flags *pflag.FlagSet) (*serveConfig, error) {
+	cfg := &serveConfig{
+		index: esIndex,
+		sink: sinkConfig{
+			host:          esHost,
+			port:          esPort,
+			workers:       serveWorkers,
+			bulkActions:   serveBulkActions,
+			bulkSize:      serveBulkSize,
+			flushInterval: serveFlushInterval,
+		},
+	}
+	fromFile := func(key string, flag string) bool {
+		return viper.IsSet("serve."+key) && !flags.Changed(flag)
+	}
+	if fromFile("index", "index") {
+		cfg.index = viper.GetString("serve.index")
+	}
+	if fromFile("host", "host") {
+		cfg.sink.host = viper.GetString("serve.host")
+	}
+	if fromFile("port", "port") {
+		cfg.sink.port = viper.GetString("serve.port")
+	}
+	if fromFile("workers", "workers") {
+		cfg.sink.workers = viper.GetInt("serve.workers")
+	}
+	if fromFile("bulk_actions", "bulk-actions") {
+		cfg.sink.bulkActions = viper.GetInt("serve.bulk_actions")
+	}
+	if fromFile("bulk_size", "bulk-size") {
+		cfg.sink.bulkSize = viper.GetInt("serve.bulk_size")
+	}
+	if fromFile("flush_interval", "flush-interval") {
+		cfg.sink.flushInterval = viper.GetDuration("serve.flush_interval")
+	}
+
+	if cfg.index == "" || cfg.index != strings.ToLower(cfg.index) {
+		return nil, fmt.Errorf("invalid index %q, index names must be lowercase and not empty", cfg.index)
+	}
+	if cfg.sink.host == "" || cfg.sink.port == "" {
+		return nil, fmt.Errorf("the elasticsearch host and port can not be empty")
+	}
+	if cfg.sink.workers < 1 {
+		return nil, fmt.Errorf("invalid workers %d, at least one is needed", cfg.sink.workers)
+	}
+	filter, err := loadEventFilter(flags)
+	if err != nil {
+		return nil, err
+	}
+	cfg.filter = filter
+	if cfg.ids, err = loadDocIDTemplate(flags); err != nil {
+		return nil, err
+	}
+	if cfg.routes, err = loadRouter(); err != nil {
+		return nil, err
+	}
+	if cfg.redact, err = loadRedactor(flags); err != nil {
+		return nil, err
+	}
+	if cfg.fields, err = loadFieldMapping(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// currentConfig returns the configuration events are indexed with.
+func (s *eventServer) currentConfig() *serveConfig {
+	return s.config.Load().(*serveConfig)
+}
+
+// reload rereads the config file and switches to the new configuration. A config file that can not be read or is
+// not valid leaves the running configuration in place.
+func (s *eventServer) reload(reason string) {
+	fields := logrus.Fields{
+		"check":      "sensupluginses",
+		"client":     host,
+		"configFile": viper.ConfigFileUsed(),
+		"reason":     reason,
+	}
+
+	if err := viper.ReadInConfig(); err != nil {
+		fields["error"] = err
+		syslogLog.WithFields(fields).Error(`Could not read the config file, keeping the running configuration`)
+		return
+	}
+	cfg, err := loadServeConfig(s.flags)
+	if err == nil && cfg.sink != s.currentSink() {
+		err = s.connect(cfg.sink)
+	}
+	if err == nil {
+		err = s.ensureIndex(cfg.index)
+	}
+	if err != nil {
+		fields["error"] = err
+		syslogLog.WithFields(fields).Error(`Invalid configuration, keeping the running configuration`)
+		return
+	}
+
+	s.config.Store(cfg)
+	fields["esIndex"] = cfg.index
+	fields["esHost"] = cfg.sink.host
+	fields["esPort"] = cfg.sink.port
+	syslogLog.WithFields(fields).Info(`Reloaded the configuration`)
+}
+
+// watchConfig watches the directory holding the config file so that edits, including editors that save by
+// replacing the file, are noticed. It returns nil when no config file is in use.
+func watchConfig() (*fsnotify.Watcher, error) {
+	if viper.ConfigFileUsed() == "" {
+		return nil, nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(viper.ConfigFileUsed())); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// isConfigChange reports whether a file system event replaced or modified the config file.
+func isConfigChange(event fsnotify.Event) bool {
+	if filepath.Clean(event.Name) != filepath.Clean(viper.ConfigFileUsed()) {
+		return false
+	}
+	return event.Op&(fsnotify.Write|fsnotify.Create) != 0
+}
@@ -0,0 +1,193 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/olivere/elastic"
+	"golang.org/x/net/context"
+)
+
+// serve http configuration
+var serveHTTP string
+var serveQueueSaturation float64
+
+// bulkLatencyBuckets are the upper bounds, in seconds, of the bulk request latency histogram.
+var bulkLatencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// serverStats counts what the event server has done. The counters come first so they stay 64 bit aligned for
+// the atomic operations on 32 bit platforms.
+type serverStats struct {
+	received     int64
+	decodeErrors int64
+	filtered     int64
+	unchanged    int64
+	indexed      int64
+	superseded   int64
+	failed       int64
+
+	mu          sync.Mutex
+	bulkStarted map[int64]time.Time
+	bulkCounts  []int64
+	bulkSum     float64
+	bulkTotal   int64
+}
+
+// beforeBulk records when a bulk request was sent.
+func (s *eventServer) beforeBulk(executionID int64, requests []elastic.BulkableRequest) {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	if s.stats.bulkStarted == nil {
+		s.stats.bulkStarted = make(map[int64]time.Time)
+	}
+	s.stats.bulkStarted[executionID] = time.Now()
+}
+
+// observeBulk records the outcome and latency of a bulk request.
+func (s *eventServer) observeBulk(executionID int64, requests []elastic.BulkableRequest, res *elastic.BulkResponse, err error) {
+	switch {
+	case err != nil || res == nil:
+		atomic.AddInt64(&s.stats.failed, int64(len(requests)))
+	default:
+		rejected := len(bulkRejected(res))
+		atomic.AddInt64(&s.stats.failed, int64(rejected))
+		atomic.AddInt64(&s.stats.superseded, int64(len(res.Failed())-rejected))
+		atomic.AddInt64(&s.stats.indexed, int64(len(res.Succeeded())))
+	}
+
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	started, ok := s.stats.bulkStarted[executionID]
+	if !ok {
+		return
+	}
+	delete(s.stats.bulkStarted, executionID)
+
+	took := time.Since(started).Seconds()
+	if s.stats.bulkCounts == nil {
+		s.stats.bulkCounts = make([]int64, len(bulkLatencyBuckets))
+	}
+	for i, bound := range bulkLatencyBuckets {
+		if took <= bound {
+			s.stats.bulkCounts[i]++
+		}
+	}
+	s.stats.bulkSum += took
+	s.stats.bulkTotal++
+}
+
+// listenHTTP serves the health and metrics endpoints.
+func (s *eventServer) listenHTTP(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.listeners = append(s.listeners, l)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/metrics", s.metrics)
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			select {
+			case <-s.done:
+			default:
+				syslogLog.WithFields(logrus.Fields{
+					"check":  "sensupluginses",
+					"client": host,
+					"error":  err,
+					"http":   address,
+				}).Error(`The health and metrics listener stopped`)
+			}
+		}
+	}()
+	return nil
+}
+
+// healthz reports whether elasticsearch can be reached and the queue has room.
+func (s *eventServer) healthz(w http.ResponseWriter, r *http.Request) {
+	var problems []string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.currentClient().ClusterHealth().Do(ctx); err != nil {
+		problems = append(problems, fmt.Sprintf("elasticsearch unreachable: %v", err))
+	}
+	if depth, capacity := len(s.queue), cap(s.queue); capacity > 0 && float64(depth) >= serveQueueSaturation*float64(capacity) {
+		problems = append(problems, fmt.Sprintf("queue saturated: %d of %d", depth, capacity))
+	}
+
+	if len(problems) > 0 {
+		http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// metrics writes the server stats in the prometheus text format.
+func (s *eventServer) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	counter := func(name string, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	gauge := func(name string, help string, value int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+	}
+
+	counter("sensupluginses_events_received_total", "Sensu events received over the handler sockets.", atomic.LoadInt64(&s.stats.received))
+	counter("sensupluginses_events_decode_errors_total", "Payloads that could not be decoded as sensu events.", atomic.LoadInt64(&s.stats.decodeErrors))
+	counter("sensupluginses_events_filtered_total", "Events dropped by the event filter.", atomic.LoadInt64(&s.stats.filtered))
+	counter("sensupluginses_events_unchanged_total", "Events not written because their document had not changed.", atomic.LoadInt64(&s.stats.unchanged))
+	counter("sensupluginses_documents_indexed_total", "Documents elasticsearch accepted.", atomic.LoadInt64(&s.stats.indexed))
+	counter("sensupluginses_documents_superseded_total", "Documents not written because a newer version was already indexed.", atomic.LoadInt64(&s.stats.superseded))
+	counter("sensupluginses_documents_failed_total", "Documents elasticsearch rejected or that could not be sent.", atomic.LoadInt64(&s.stats.failed))
+	gauge("sensupluginses_queue_depth", "Events waiting to be indexed.", len(s.queue))
+	gauge("sensupluginses_queue_capacity", "Events that may wait to be indexed before the sockets stop reading.", cap(s.queue))
+	gauge("sensupluginses_spool_size", "Documents not yet acknowledged by elasticsearch, which are spooled when stopping.", s.pendingCount())
+
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	name := "sensupluginses_bulk_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of bulk requests to elasticsearch.\n# TYPE %s histogram\n", name, name)
+	for i, bound := range bulkLatencyBuckets {
+		var count int64
+		if s.stats.bulkCounts != nil {
+			count = s.stats.bulkCounts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, count)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", name, s.stats.bulkTotal, name, s.stats.bulkSum, name, s.stats.bulkTotal)
+}
+
+func init() {
+	serveCmd.Flags().StringVarP(&serveHTTP, "http", "", "", "the address to serve /healthz and /metrics on")
+	serveCmd.Flags().Float64VarP(&serveQueueSaturation, "queue-saturation", "", 0.9, "the fraction of the queue in use at which /healthz fails")
+}
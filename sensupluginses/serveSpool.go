@@ -0,0 +1,174 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/olivere/elastic"
+)
+
+// serve spool configuration
+var serveDrainTimeout time.Duration
+var serveSpoolDir string
+
+// spooledDocument is a status document that has been handed to the bulk processor but not yet acknowledged by
+// elasticsearch. It is what gets written to the spool when the server can not flush before exiting. The bulk
+// workers send requests concurrently, so the version keeps an older document from replacing a newer one.
+type spooledDocument struct {
+	Index   string                 `json:"index"`
+	Type    string                 `json:"type"`
+	ID      string                 `json:"id"`
+	Version int64                  `json:"version,omitempty"`
+	Doc     map[string]interface{} `json:"doc"`
+
+	request *elastic.BulkIndexRequest
+}
+
+// pendingKey identifies a pending document. Status documents are keyed on the client and check so only the latest
+// document per key is kept, which bounds the spool by the number of checks rather than the number of events.
+func pendingKey(index string, id string) string {
+	return index + "/" + id
+}
+
+// track records a document as pending and returns the bulk request that indexes it.
+func (s *eventServer) track(d *spooledDocument) *elastic.BulkIndexRequest {
+	d.request = elastic.NewBulkIndexRequest().Index(d.Index).Type(d.Type).Id(d.ID).Doc(d.Doc)
+	if d.Version > 0 {
+		d.request.Version(d.Version).VersionType(versionType)
+	}
+
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	s.pending[pendingKey(d.Index, d.ID)] = d
+	return d.request
+}
+
+// acknowledge forgets the pending documents elasticsearch accepted or already holds a newer version of. A document
+// replaced by a newer one while its request was in flight stays pending. Rejected documents are dropped from the
+// write cache so the next event for them is written whatever the write mode.
+func (s *eventServer) acknowledge(requests []elastic.BulkableRequest, res *elastic.BulkResponse) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+
+	for i, item := range res.Items {
+		if i >= len(requests) {
+			break
+		}
+		for _, result := range item {
+			key := pendingKey(result.Index, result.Id)
+			if (result.Status < 200 || result.Status > 299) && result.Status != http.StatusConflict {
+				s.writes.forget(key)
+				continue
+			}
+			if d, ok := s.pending[key]; ok && d.request == requests[i] {
+				delete(s.pending, key)
+			}
+		}
+	}
+}
+
+// pendingCount returns the number of documents that would be spooled if the server stopped now.
+func (s *eventServer) pendingCount() int {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	return len(s.pending)
+}
+
+// writeSpool saves every pending document to a new file in the spool directory.
+func (s *eventServer) writeSpool() {
+	s.pendingMu.Lock()
+	docs := make([]*spooledDocument, 0, len(s.pending))
+	for _, d := range s.pending {
+		docs = append(docs, d)
+	}
+	s.pendingMu.Unlock()
+
+	if len(docs) == 0 {
+		return
+	}
+
+	path := filepath.Join(serveSpoolDir, fmt.Sprintf("spool-%d.json", time.Now().UnixNano()))
+	fields := logrus.Fields{
+		"check":     "sensupluginses",
+		"client":    host,
+		"documents": len(docs),
+		"spool":     path,
+	}
+	if err := writeState(path, docs); err != nil {
+		fields["error"] = err
+		syslogLog.WithFields(fields).Error(`Could not spool the pending documents, they are lost`)
+		return
+	}
+	syslogLog.WithFields(fields).Warn(`Spooled the documents that could not be indexed before exiting`)
+}
+
+// replaySpool hands the documents spooled by a previous run to the bulk processor and removes the spool files.
+// The documents are pending again so anything that still can not be indexed is spooled once more on exit.
+func (s *eventServer) replaySpool() {
+	files, err := ioutil.ReadDir(serveSpoolDir)
+	if err != nil {
+		return
+	}
+
+	var names []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "spool-") && strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(serveSpoolDir, name)
+		fields := logrus.Fields{
+			"check":  "sensupluginses",
+			"client": host,
+			"spool":  path,
+		}
+
+		var docs []*spooledDocument
+		if !readState(path, &docs) {
+			syslogLog.WithFields(fields).Error(`Could not read a spool file, leaving it in place`)
+			continue
+		}
+		for _, d := range docs {
+			s.add(d)
+		}
+		os.Remove(path)
+
+		fields["documents"] = len(docs)
+		syslogLog.WithFields(fields).Info(`Replayed spooled documents`)
+	}
+}
+
+func init() {
+	serveCmd.Flags().DurationVarP(&serveDrainTimeout, "drain-timeout", "", 30*time.Second, "how long to wait for pending documents to be indexed when stopping")
+	serveCmd.Flags().StringVarP(&serveSpoolDir, "spool-dir", "", filepath.Join(DefaultStateDir, "spool"), "where documents that could not be indexed before stopping are kept")
+}
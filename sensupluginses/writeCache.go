@@ -0,0 +1,194 @@
+// Copyright © 2017 Yieldbot <devops@yieldbot.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sensupluginses
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// write mode configuration
+var writeModeFlag string
+var writeModeFields []string
+var writeCachePath string
+
+// writeCacheTTL is how long an entry stays in the write cache without being written again. Forgetting an entry
+// only costs one extra write, so this just keeps the cache from growing with documents that no longer exist.
+const writeCacheTTL = 24 * time.Hour
+
+// writeMode decides whether a status document is written when nothing about it has changed.
+type writeMode struct {
+	onChange bool
+	every    time.Duration
+}
+
+// parseWriteMode reads always, on-change or on-change-or-every=<duration>. Under on-change an unchanged document
+// is only rewritten once its cache entry outlives writeCacheTTL, so incident_timestamp can be up to a day old on a
+// healthy check.
+func parseWriteMode(s string) (writeMode, error) {
+	switch {
+	case s == "always":
+		return writeMode{}, nil
+	case s == "on-change":
+		return writeMode{onChange: true}, nil
+	case strings.HasPrefix(s, "on-change-or-every="):
+		every, err := time.ParseDuration(strings.TrimPrefix(s, "on-change-or-every="))
+		if err != nil || every <= 0 {
+			return writeMode{}, fmt.Errorf("invalid heartbeat interval in write mode %q", s)
+		}
+		return writeMode{onChange: true, every: every}, nil
+	default:
+		return writeMode{}, fmt.Errorf("invalid write mode %q, expected always, on-change or on-change-or-every=<duration>", s)
+	}
+}
+
+// lastWrite is what the write cache remembers about a document: a digest of the compared fields and when it was
+// last written, in unix seconds.
+type lastWrite struct {
+	Digest  string `json:"d"`
+	Written int64  `json:"w"`
+}
+
+// writeCache remembers the last write of every status document.
+type writeCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]lastWrite
+}
+
+// openWriteCache loads the write cache from path. A missing or unreadable cache starts empty, which only means the
+// next event for every document is written.
+func openWriteCache(path string) *writeCache {
+	c := &writeCache{path: path, entries: make(map[string]lastWrite)}
+	readState(path, &c.entries)
+	return c
+}
+
+// loadWriteCache loads the write cache under the cache lock.
+func loadWriteCache(path string) *writeCache {
+	if lock, err := lockWriteCache(path); err == nil {
+		defer lock.Close()
+	}
+	return openWriteCache(path)
+}
+
+// documentDigest hashes the compared fields of a status document.
+func documentDigest(doc map[string]interface{}, fields []string) string {
+	h := fnv.New64a()
+	for _, f := range fields {
+		v, _ := json.Marshal(doc[f])
+		fmt.Fprintf(h, "%s=%s\n", f, v)
+	}
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// shouldWrite reports whether the document needs writing under the write mode and, if so, records the write. Keys
+// identify the document across indices.
+func (c *writeCache) shouldWrite(mode writeMode, key string, doc map[string]interface{}, now time.Time) bool {
+	if !mode.onChange {
+		return true
+	}
+	digest := documentDigest(doc, writeModeFields)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last, ok := c.entries[key]
+	if ok && last.Digest == digest && (mode.every <= 0 || now.Sub(time.Unix(last.Written, 0)) < mode.every) {
+		return false
+	}
+	c.entries[key] = lastWrite{Digest: digest, Written: now.Unix()}
+	return true
+}
+
+// forget drops the entry for a document so that its next event is written, e.g. after a write failed.
+func (c *writeCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// updateWriteCache loads the cache, hands it to fn and saves it while holding an exclusive lock on it, so that
+// handlers running concurrently never write back each other's stale entries.
+func updateWriteCache(path string, now time.Time, fn func(*writeCache)) error {
+	lock, err := lockWriteCache(path)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	c := openWriteCache(path)
+	fn(c)
+	return c.store(now)
+}
+
+// lockWriteCache takes an exclusive lock on the cache at path. Closing the returned file releases it.
+func lockWriteCache(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// save writes the cache back to disk under the cache lock.
+func (c *writeCache) save(now time.Time) error {
+	lock, err := lockWriteCache(c.path)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	return c.store(now)
+}
+
+// store writes the cache back to disk, dropping entries that have outlived writeCacheTTL.
+func (c *writeCache) store(now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, last := range c.entries {
+		if now.Sub(time.Unix(last.Written, 0)) > writeCacheTTL {
+			delete(c.entries, key)
+		}
+	}
+	return writeState(c.path, c.entries)
+}
+
+// addWriteModeFlags adds the flags that skip writing documents whose state has not changed.
+func addWriteModeFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&writeModeFlag, "write-mode", "", "always", "always, on-change or on-change-or-every=<duration>")
+	cmd.Flags().StringSliceVarP(&writeModeFields, "write-mode-fields", "", []string{"check_state"}, "the document fields compared by the on-change write modes")
+	cmd.Flags().StringVarP(&writeCachePath, "write-cache", "", filepath.Join(DefaultStateDir, "write-cache.json"), "where the last write of every document is remembered")
+}